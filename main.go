@@ -1,7 +1,154 @@
 package main
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"turing/resolve/store"
+)
+
+const storeUsage = `usage: resolve store <command> [options]
+
+commands:
+  ls        列出目录下的所有文件, 包括大小、偏移量、记录数量与首尾记录的写入时间
+  dump      从指定的偏移量开始输出解码后的记录
+  verify    校验所有记录的 CRC, 报告第一条损坏记录的位置
+  truncate  删除指定偏移量之后的所有数据, 执行前需要停止使用该目录的进程
+`
+
+// errUsage 命令或者参数不正确
+var errUsage = errors.New("usage")
+
 func main() {
+	err := errUsage
+	if len(os.Args) >= 2 && os.Args[1] == "store" {
+		err = runStoreCommand(os.Args[2:])
+	}
+
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, storeUsage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
 
+// runStoreCommand 执行 store 的子命令
+func runStoreCommand(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	command, args := args[0], args[1:]
+	flagSet := flag.NewFlagSet("store "+command, flag.ExitOnError)
+	dir := flagSet.String("dir", "", "MappedFileQueue 文件所在的目录, 例如 rootDir/commitlog")
+
+	switch command {
+	case "ls":
+		_ = flagSet.Parse(args)
+		return listSegments(*dir)
+	case "dump":
+		fromOffset := flagSet.Int64("from-offset", 0, "开始读取的全局偏移量, 需要对齐到记录的起始位置")
+		limit := flagSet.Int("limit", 100, "最多输出的记录数量, 小于等于0时不限制")
+		maxBody := flagSet.Int("max-body", 64, "每条记录最多输出的内容长度")
+		_ = flagSet.Parse(args)
+		return dumpRecords(*dir, *fromOffset, *limit, *maxBody)
+	case "verify":
+		_ = flagSet.Parse(args)
+		return verifySegments(*dir)
+	case "truncate":
+		at := flagSet.Int64("at", -1, "截断的全局偏移量, 需要对齐到记录的起始位置")
+		_ = flagSet.Parse(args)
+		if *at < 0 {
+			return fmt.Errorf("--at is required")
+		}
+		return truncateSegments(*dir, *at)
+	default:
+		return errUsage
+	}
+}
+
+func listSegments(dir string) error {
+	segments, err := store.ListSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-22s %12s %20s %12s %8s %-23s %-23s\n", "FILE", "SIZE", "FROM OFFSET", "VALID", "RECORDS", "FIRST TIMESTAMP", "LAST TIMESTAMP")
+	for _, segment := range segments {
+		fmt.Printf("%-22s %12d %20d %12d %8d %-23s %-23s\n", filepath.Base(segment.FileName), segment.FileSize, segment.FileFromOffset,
+			segment.ValidLength, segment.RecordCount, formatTimestamp(segment.FirstTimestamp), formatTimestamp(segment.LastTimestamp))
+		if segment.Err != nil {
+			fmt.Printf("  corrupt at %d: %v\n", segment.FileFromOffset+segment.ValidLength, segment.Err)
+		}
+	}
+	return nil
+}
 
+func dumpRecords(dir string, fromOffset int64, limit int, maxBody int) error {
+	count := 0
+	err := store.DumpRecords(dir, fromOffset, func(offset int64, record *store.Record) bool {
+		body := record.Body
+		if len(body) > maxBody {
+			body = body[:maxBody]
+		}
+
+		fmt.Printf("offset=%d size=%d topic=%s queueId=%d queueOffset=%d storeTimestamp=%s compression=%s properties=%s body=%q\n",
+			offset, record.TotalSize, record.Topic, record.QueueId, record.QueueOffset, formatTimestamp(record.StoreTimestamp),
+			record.Compression, formatProperties(record.Properties), body)
+		count++
+		return limit <= 0 || count < limit
+	})
+
+	fmt.Printf("%d records\n", count)
+	return err
+}
+
+func verifySegments(dir string) error {
+	report, err := store.VerifySegments(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("files: %d, records: %d, max offset: %d\n", report.FileCount, report.RecordCount, report.MaxOffset)
+	if report.CorruptOffset >= 0 {
+		return fmt.Errorf("first corrupt position %d: %w", report.CorruptOffset, report.CorruptErr)
+	}
+
+	fmt.Println("ok")
+	return nil
+}
+
+func truncateSegments(dir string, at int64) error {
+	if err := store.TruncateSegments(dir, at); err != nil {
+		return err
+	}
+
+	fmt.Printf("truncated at %d\n", at)
+	return nil
+}
+
+func formatTimestamp(timestamp int64) string {
+	if timestamp <= 0 {
+		return "-"
+	}
+	return time.UnixMilli(timestamp).Format("2006-01-02 15:04:05.000")
+}
 
+func formatProperties(properties map[string]string) string {
+	pairs := make([]string, 0, len(properties))
+	for name, value := range properties {
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
 }
@@ -0,0 +1,298 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/panjf2000/ants/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	poolSize = 1 << 3
+
+	//allocateWaitTimeout 等待文件创建完成的超时时间
+	allocateWaitTimeout = 5 * time.Second
+
+	//ErrAllocateServiceStopped 创建服务没有启动或者已经关闭
+	ErrAllocateServiceStopped = errors.New("allocate service is not running")
+
+	//ErrAllocateTimeout 等待文件创建超时
+	ErrAllocateTimeout = errors.New("get file timeout")
+)
+
+type AllocateRequest struct {
+	FileName   string
+	stopSh     chan struct{}
+	mappedFile *MappedFile
+	fileSize   int64
+	err        error
+}
+
+func (req *AllocateRequest) Done() <-chan struct{} {
+	return req.stopSh
+}
+
+// Stop 通知等待的调用方文件已经创建完成, 关闭通道可以同时唤醒多个调用方且不会在无人等待时阻塞
+func (req *AllocateRequest) Stop() {
+	close(req.stopSh)
+}
+
+// destroyUnusedFile 删除请求创建但没有被使用的文件
+func (req *AllocateRequest) destroyUnusedFile() {
+	if req.mappedFile == nil {
+		return
+	}
+
+	if err := req.mappedFile.Destroy(0); err != nil {
+		Logger.Error("Destroy unused MappedFile error: ", err)
+	}
+}
+
+func NewAllocateRequest(fileName string, fileSize int64) *AllocateRequest {
+	return &AllocateRequest{
+		FileName: fileName,
+		stopSh:   make(chan struct{}),
+		fileSize: fileSize,
+	}
+}
+
+// AllocateService 在后台创建 MappedFile, 每个 MappedFileQueue 拥有独立的实例
+type AllocateService struct {
+	//保护 requestMap 与 running
+	lock sync.Mutex
+
+	//用于存储创建好的MappedFile文件
+	requestMap map[string]*AllocateRequest
+
+	Pool *ants.PoolWithFunc
+
+	running bool
+
+	config *QueueConfig
+
+	//创建文件的存储后端
+	storage Storage
+
+	//写入缓冲池, 为nil时创建的文件直接写入映射区域
+	transientStorePool *TransientStorePool
+
+	//获取文件的次数
+	requests int64
+
+	//文件没有预先创建好, 写入方需要等待的次数
+	waits int64
+
+	//写入方等待的总时长
+	waitNanos int64
+}
+
+// AllocateMetrics 文件创建的统计信息
+type AllocateMetrics struct {
+	//获取文件的次数
+	Requests int64
+
+	//文件没有预先创建好, 写入方需要等待的次数
+	Waits int64
+
+	//写入方等待的总时长
+	WaitTime time.Duration
+}
+
+func NewAllocateService(config *QueueConfig, storage Storage, transientStorePool *TransientStorePool) *AllocateService {
+	return &AllocateService{
+		requestMap:         make(map[string]*AllocateRequest),
+		config:             config,
+		storage:            storage,
+		transientStorePool: transientStorePool,
+	}
+}
+
+// AddRequest 获取 nextFile 对应的文件, 同时在后台预先创建 preAllocateFiles
+// nextFile 已经预先创建完成时立即返回, 否则等待创建完成
+func (service *AllocateService) AddRequest(nextFile string, fileSize int64, preAllocateFiles ...string) (*MappedFile, error) {
+	if strings.TrimSpace(nextFile) == "" {
+		return nil, errors.New("nextFile name must not be null")
+	}
+	for _, preAllocateFile := range preAllocateFiles {
+		if strings.TrimSpace(preAllocateFile) == "" {
+			return nil, errors.New("preAllocateFile name must not be null")
+		}
+	}
+
+	service.lock.Lock()
+	if !service.running {
+		service.lock.Unlock()
+		return nil, ErrAllocateServiceStopped
+	}
+
+	//判断数据是否已经存在, 不存在的请求记录到请求表中, 之后的调用可以直接取走
+	newRequests := make([]*AllocateRequest, 0, len(preAllocateFiles)+1)
+	request, exists := service.requestMap[nextFile]
+	if !exists {
+		request = NewAllocateRequest(nextFile, fileSize)
+		service.requestMap[nextFile] = request
+		newRequests = append(newRequests, request)
+	}
+
+	for _, preAllocateFile := range preAllocateFiles {
+		if _, ok := service.requestMap[preAllocateFile]; !ok {
+			preAllocateRequest := NewAllocateRequest(preAllocateFile, fileSize)
+			service.requestMap[preAllocateFile] = preAllocateRequest
+			newRequests = append(newRequests, preAllocateRequest)
+		}
+	}
+	service.lock.Unlock()
+
+	//添加请求, 线程池已满时会阻塞, 因此不能在锁内提交
+	for _, newRequest := range newRequests {
+		service.invoke(newRequest)
+	}
+
+	atomic.AddInt64(&service.requests, 1)
+	if err := service.waitRequest(request); err != nil {
+		return nil, err
+	}
+
+	//删除数据, 创建失败时下一次调用会重新创建
+	service.lock.Lock()
+	owned := service.requestMap[nextFile] == request
+	if owned {
+		delete(service.requestMap, nextFile)
+	}
+	service.lock.Unlock()
+
+	//请求已经被 Shutdown 取走, 文件会在 Shutdown 中删除
+	if !owned {
+		return nil, ErrAllocateServiceStopped
+	}
+
+	if request.err != nil {
+		return nil, request.err
+	}
+	return request.mappedFile, nil
+}
+
+// waitRequest 等待文件创建完成, 文件没有预先创建好时记录等待的次数与时长
+func (service *AllocateService) waitRequest(request *AllocateRequest) error {
+	select {
+	case <-request.Done():
+		return nil
+	default:
+	}
+
+	startTime := time.Now()
+	defer func() {
+		atomic.AddInt64(&service.waits, 1)
+		atomic.AddInt64(&service.waitNanos, int64(time.Since(startTime)))
+	}()
+
+	timer := time.NewTimer(allocateWaitTimeout)
+	defer timer.Stop()
+
+	select {
+	//等待请求创建完成
+	case <-request.Done():
+		return nil
+	//超时时间为5s
+	case <-timer.C:
+		return ErrAllocateTimeout
+	}
+}
+
+// Metrics 获取文件创建的统计信息
+func (service *AllocateService) Metrics() AllocateMetrics {
+	return AllocateMetrics{
+		Requests: atomic.LoadInt64(&service.requests),
+		Waits:    atomic.LoadInt64(&service.waits),
+		WaitTime: time.Duration(atomic.LoadInt64(&service.waitNanos)),
+	}
+}
+
+// invoke 提交创建请求, 提交失败时直接结束请求
+func (service *AllocateService) invoke(request *AllocateRequest) {
+	if err := service.Pool.Invoke(request); err != nil {
+		request.err = err
+		request.Stop()
+	}
+}
+
+// Start 启动内部携程
+func (service *AllocateService) Start() error {
+	handler := ants.WithPanicHandler(func(i interface{}) {
+		Logger.Error(i)
+	})
+
+	pool, err := ants.NewPoolWithFunc(poolSize, service.createFile, handler)
+	if err != nil {
+		return err
+	}
+
+	service.lock.Lock()
+	service.Pool = pool
+	service.running = true
+	service.lock.Unlock()
+	return nil
+}
+
+// Shutdown 停止接收新的请求, 等待正在创建的文件完成后删除预先创建但没有被使用的文件
+// ctx 结束时不再等待, 直接释放线程池, 剩余的文件在创建完成之后于后台删除
+func (service *AllocateService) Shutdown(ctx context.Context) error {
+	service.lock.Lock()
+	service.running = false
+	requests := make([]*AllocateRequest, 0, len(service.requestMap))
+	for _, request := range service.requestMap {
+		requests = append(requests, request)
+	}
+	service.requestMap = make(map[string]*AllocateRequest)
+	service.lock.Unlock()
+
+	defer service.Pool.Release()
+
+	for i, request := range requests {
+		select {
+		case <-request.Done():
+		case <-ctx.Done():
+			go destroyUnusedFiles(requests[i:])
+			return ctx.Err()
+		}
+
+		request.destroyUnusedFile()
+	}
+
+	return nil
+}
+
+// destroyUnusedFiles 等待请求的文件创建完成之后删除
+func destroyUnusedFiles(requests []*AllocateRequest) {
+	for _, request := range requests {
+		<-request.Done()
+		request.destroyUnusedFile()
+	}
+}
+
+// createFile 创建文件的流程
+func (service *AllocateService) createFile(data interface{}) {
+	request := data.(*AllocateRequest)
+	fileName := request.FileName
+	Logger.Infof("接收到创建请求: %s", fileName)
+	mappedFile, err := NewTransientMappedFile(service.storage, fileName, request.fileSize, service.transientStorePool)
+	if err != nil {
+		Logger.Error("Create MappedFile error: ", err)
+	}
+
+	if err == nil && service.config.WarmMappedFile {
+		err = mappedFile.WarmUp(service.config.WarmUpYieldPages, service.config.MadviseWillNeed, service.config.MlockMappedFile)
+		if err != nil {
+			Logger.Error("Warm up MappedFile error: ", err)
+			_ = mappedFile.Destroy(0)
+			mappedFile = nil
+		}
+	}
+	request.mappedFile = mappedFile
+	request.err = err
+	//创建完成后不在阻塞创建线程
+	request.Stop()
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/afero"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllocateServiceLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	service := NewAllocateService(DefaultQueueConfig(), defaultStorage, nil)
+	if err := service.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	nextFile := filepath.Join(dir, fmt.Sprintf("%020d", 0))
+	nextNextFile := filepath.Join(dir, fmt.Sprintf("%020d", 1024))
+	mappedFile, err := service.AddRequest(nextFile, 1024, nextNextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mappedFile.Close()
+
+	//预先创建但没有被取走的文件在关闭时删除
+	if err := service.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(nextNextFile); !os.IsNotExist(err) {
+		t.Fatalf("expect %s to be removed, got %v", nextNextFile, err)
+	}
+	if _, err := os.Stat(nextFile); err != nil {
+		t.Fatalf("expect %s to be kept, got %v", nextFile, err)
+	}
+
+	if _, err := service.AddRequest(nextNextFile, 1024); err != ErrAllocateServiceStopped {
+		t.Fatalf("expect allocate service stopped, got %v", err)
+	}
+}
+
+func TestAllocateServicePreAllocate(t *testing.T) {
+	dir := t.TempDir()
+	service := NewAllocateService(DefaultQueueConfig(), defaultStorage, nil)
+	if err := service.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer service.Shutdown(context.Background())
+
+	fileNames := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		fileNames = append(fileNames, filepath.Join(dir, fmt.Sprintf("%020d", i*1024)))
+	}
+
+	if _, err := service.AddRequest(fileNames[0], 1024, fileNames[1], fileNames[2]); err != nil {
+		t.Fatal(err)
+	}
+	waits := service.Metrics().Waits
+
+	//等待预先创建的文件完成, 之后获取文件不需要再等待
+	for _, fileName := range fileNames[1:3] {
+		<-service.requestMap[fileName].Done()
+	}
+	for i := 1; i < 3; i++ {
+		if _, err := service.AddRequest(fileNames[i], 1024, fileNames[i+1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metrics := service.Metrics()
+	if metrics.Requests != 3 || metrics.Waits != waits {
+		t.Fatalf("unexpected allocate metrics %#v", metrics)
+	}
+}
+
+func TestAllocateServicePropagateError(t *testing.T) {
+	service := NewAllocateService(DefaultQueueConfig(), defaultStorage, nil)
+	if err := service.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer service.Shutdown(context.Background())
+
+	dir := filepath.Join(t.TempDir(), "not-exists")
+	_, err := service.AddRequest(filepath.Join(dir, fmt.Sprintf("%020d", 0)), 1024, filepath.Join(dir, fmt.Sprintf("%020d", 1024)))
+	if err == nil {
+		t.Fatal("expect create file error")
+	}
+}
+
+func TestAllocateServiceWarmUp(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultQueueConfig()
+	config.WarmMappedFile = true
+	config.MadviseWillNeed = true
+	config.WarmUpYieldPages = 1
+
+	service := NewAllocateService(config, defaultStorage, nil)
+	if err := service.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer service.Shutdown(context.Background())
+
+	fileSize := pageSize * 4
+	mappedFile, err := service.AddRequest(filepath.Join(dir, fmt.Sprintf("%020d", 0)), fileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mappedFile.Close()
+
+	//预热不会改变文件内容, 写入的位置从0开始
+	if mappedFile.GetWritePosition() != 0 {
+		t.Fatalf("unexpected wrote position %d", mappedFile.GetWritePosition())
+	}
+	stat, err := os.Stat(mappedFile.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != fileSize {
+		t.Fatalf("expect file size %d, got %d", fileSize, stat.Size())
+	}
+}
+
+// stallingStorage 创建 stalledFile 时阻塞, 直到 release 被关闭
+type stallingStorage struct {
+	*HeapStorage
+
+	stalledFile string
+
+	release chan struct{}
+}
+
+func (storage *stallingStorage) OpenRegion(fileName string, size int64, deleteIfExists bool) (Region, error) {
+	if fileName == storage.stalledFile {
+		<-storage.release
+	}
+	return storage.HeapStorage.OpenRegion(fileName, size, deleteIfExists)
+}
+
+func TestAllocateServiceShutdownTimeout(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	nextFile := filepath.Join("/queue", fmt.Sprintf("%020d", 0))
+	nextNextFile := filepath.Join("/queue", fmt.Sprintf("%020d", 1024))
+	storage := &stallingStorage{
+		HeapStorage: NewHeapStorage(fs),
+		stalledFile: nextNextFile,
+		release:     make(chan struct{}),
+	}
+
+	service := NewAllocateService(DefaultQueueConfig(), storage, nil)
+	if err := service.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	mappedFile, err := service.AddRequest(nextFile, 1024, nextNextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mappedFile.Close()
+
+	//超时时不再等待预先创建的文件, 文件创建完成之后在后台删除
+	request := service.requestMap[nextNextFile]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := service.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	close(storage.release)
+	<-request.Done()
+	if request.mappedFile == nil {
+		t.Fatalf("expect %s to be created, got %v", nextNextFile, request.err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := fs.Stat(nextNextFile); os.IsNotExist(err) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %s to be removed after shutdown timeout", nextNextFile)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := fs.Stat(nextFile); err != nil {
+		t.Fatalf("expect %s to be kept, got %v", nextFile, err)
+	}
+}
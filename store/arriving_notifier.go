@@ -0,0 +1,36 @@
+package store
+
+import (
+	"sync"
+)
+
+// ArrivingNotifier 新数据到达的通知, 等待方先获取通道再检查条件, 条件不满足时等待通道关闭
+// 每次通知关闭当前的通道并替换为新的通道, 零值可以直接使用
+type ArrivingNotifier struct {
+	lock sync.Mutex
+
+	ch chan struct{}
+}
+
+// Wait 获取下一次通知的通道, 有新数据到达时通道会被关闭
+func (notifier *ArrivingNotifier) Wait() <-chan struct{} {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+
+	if notifier.ch == nil {
+		notifier.ch = make(chan struct{})
+	}
+	return notifier.ch
+}
+
+// NotifyAll 唤醒所有等待的协程
+func (notifier *ArrivingNotifier) NotifyAll() {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+
+	//没有协程获取过通道时不需要唤醒
+	if notifier.ch != nil {
+		close(notifier.ch)
+		notifier.ch = nil
+	}
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	//checkpointFileName 检查点文件名
+	checkpointFileName = "checkpoint"
+
+	//checkpointFileSize 检查点文件大小, 占用一个内存页
+	checkpointFileSize = 4096
+
+	//检查点文件中各个字段的位置
+	flushedOffsetPosition    = 0
+	flushTimestampPosition   = 8
+	indexFlushOffsetPosition = 16
+	shutdownStatePosition    = 24
+)
+
+const (
+	//shutdownStateRunning 正在运行, 启动时读取到该状态说明上一次没有正常关闭
+	shutdownStateRunning int32 = iota
+	//shutdownStateClean 正常关闭
+	shutdownStateClean
+)
+
+// Checkpoint 记录已经落盘的位置, 用于重启时快速恢复
+type Checkpoint struct {
+	FileName string
+
+	region Region
+
+	lock sync.Mutex
+
+	//文件是否为新创建的, 新创建的文件中没有有效的数据
+	created bool
+}
+
+// NewCheckpoint 在存储后端中打开或创建检查点文件
+func NewCheckpoint(storage Storage, fileName string) (*Checkpoint, error) {
+	_, statErr := storage.Stat(fileName)
+
+	region, err := storage.OpenRegion(fileName, checkpointFileSize, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{
+		FileName: fileName,
+		region:   region,
+		created:  statErr != nil,
+	}, nil
+}
+
+// GetFlushedOffset 已经刷盘的全局偏移量
+func (checkpoint *Checkpoint) GetFlushedOffset() int64 {
+	return checkpoint.getInt64(flushedOffsetPosition)
+}
+
+// SetFlushedOffset 记录刷盘的全局偏移量与刷盘时间
+func (checkpoint *Checkpoint) SetFlushedOffset(offset int64) {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+	region := checkpoint.region.Bytes()
+	binary.BigEndian.PutUint64(region[flushedOffsetPosition:], uint64(offset))
+	binary.BigEndian.PutUint64(region[flushTimestampPosition:], uint64(time.Now().UnixMilli()))
+}
+
+// GetFlushTimestamp 最后一次刷盘的时间, 毫秒
+func (checkpoint *Checkpoint) GetFlushTimestamp() int64 {
+	return checkpoint.getInt64(flushTimestampPosition)
+}
+
+// GetIndexFlushOffset 索引已经刷盘的位置
+func (checkpoint *Checkpoint) GetIndexFlushOffset() int64 {
+	return checkpoint.getInt64(indexFlushOffsetPosition)
+}
+
+// SetIndexFlushOffset 记录索引刷盘的位置
+func (checkpoint *Checkpoint) SetIndexFlushOffset(offset int64) {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+	binary.BigEndian.PutUint64(checkpoint.region.Bytes()[indexFlushOffsetPosition:], uint64(offset))
+}
+
+// IsCreated 检查点文件是否为新创建的
+func (checkpoint *Checkpoint) IsCreated() bool {
+	return checkpoint.created
+}
+
+// IsCleanShutdown 上一次运行是否正常关闭
+func (checkpoint *Checkpoint) IsCleanShutdown() bool {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+	return int32(binary.BigEndian.Uint32(checkpoint.region.Bytes()[shutdownStatePosition:])) == shutdownStateClean
+}
+
+// MarkRunning 标记为正在运行并立即刷盘, 进程异常退出后重启时可以感知到
+func (checkpoint *Checkpoint) MarkRunning() {
+	checkpoint.setShutdownState(shutdownStateRunning)
+	checkpoint.Flush()
+}
+
+// MarkCleanShutdown 标记为正常关闭并立即刷盘
+func (checkpoint *Checkpoint) MarkCleanShutdown() {
+	checkpoint.setShutdownState(shutdownStateClean)
+	checkpoint.Flush()
+}
+
+// Flush 将检查点刷盘
+func (checkpoint *Checkpoint) Flush() {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+	if err := checkpoint.region.Flush(0, checkpointFileSize); err != nil {
+		Logger.Error("Flush checkpoint error: ", err)
+	}
+}
+
+// Close 刷盘并关闭检查点文件
+func (checkpoint *Checkpoint) Close() error {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+
+	if err := checkpoint.region.Flush(0, checkpointFileSize); err != nil {
+		_ = checkpoint.region.Close()
+		return err
+	}
+	return checkpoint.region.Close()
+}
+
+func (checkpoint *Checkpoint) setShutdownState(state int32) {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+	binary.BigEndian.PutUint32(checkpoint.region.Bytes()[shutdownStatePosition:], uint32(state))
+}
+
+func (checkpoint *Checkpoint) getInt64(position int) int64 {
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+	return int64(binary.BigEndian.Uint64(checkpoint.region.Bytes()[position:]))
+}
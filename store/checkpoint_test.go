@@ -0,0 +1,77 @@
+package store
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRecoverFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewMappedFileQueue(dir, int64(2*(recordHeaderSize+100)))
+	if err := queue.Load(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Recover()
+	queue.Start()
+
+	for i := 0; i < 5; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	maxOffset := queue.GetMaxOffset()
+	queue.Shutdown()
+
+	//损坏检查点之前的文件, 恢复时不应该再校验该文件
+	fileName := queue.mappedFiles[0].FileName
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[4] ^= 0xFF
+	if err := os.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewMappedFileQueue(dir, queue.FileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+
+	if reopened.IsAbnormalShutdown() {
+		t.Fatal("expect clean shutdown")
+	}
+	if reopened.GetMaxOffset() != maxOffset || reopened.checkpoint.GetFlushedOffset() != maxOffset {
+		t.Fatalf("expect max offset %d, got %d", maxOffset, reopened.GetMaxOffset())
+	}
+	if reopened.checkpoint.GetFlushTimestamp() == 0 {
+		t.Fatal("expect flush timestamp to be recorded")
+	}
+}
+
+func TestDetectAbnormalShutdown(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewMappedFileQueue(dir, fileSize)
+	if err := queue.Load(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Recover()
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	//没有调用 Shutdown, 模拟进程异常退出
+	reopened := NewMappedFileQueue(dir, fileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+
+	if !reopened.IsAbnormalShutdown() {
+		t.Fatal("expect abnormal shutdown")
+	}
+	if reopened.GetMaxOffset() != queue.GetMaxOffset() {
+		t.Fatalf("expect max offset %d, got %d", queue.GetMaxOffset(), reopened.GetMaxOffset())
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// CleanService 定时清理过期文件
+// 文件超过保留时间、文件总大小超过限制或者磁盘使用率超过水位时删除最旧的文件
+type CleanService struct {
+	queue *MappedFileQueue
+
+	config *QueueConfig
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+}
+
+func NewCleanService(queue *MappedFileQueue, config *QueueConfig) *CleanService {
+	return &CleanService{
+		queue:  queue,
+		config: config,
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (service *CleanService) Start() {
+	service.waitGroup.Add(1)
+	go service.run()
+}
+
+func (service *CleanService) Shutdown() {
+	close(service.stopCh)
+	service.waitGroup.Wait()
+}
+
+func (service *CleanService) run() {
+	defer service.waitGroup.Done()
+
+	ticker := time.NewTicker(service.config.CleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.stopCh:
+			return
+		case <-ticker.C:
+			service.clean()
+		}
+	}
+}
+
+// clean 执行一次清理, 返回删除的文件数量
+func (service *CleanService) clean() int {
+	cleanImmediately := service.isSpaceFull()
+	deleteCount := service.queue.DeleteExpiredFiles(service.config.FileReservedTime,
+		service.config.DestroyIntervalForcibly, cleanImmediately, service.config.DeleteFilesBatchMax)
+	if deleteCount > 0 {
+		Logger.Infof("清理过期文件 %d 个, 是否立即清理: %v", deleteCount, cleanImmediately)
+	}
+
+	return deleteCount
+}
+
+// isSpaceFull 文件总大小或者磁盘使用率是否超过限制
+func (service *CleanService) isSpaceFull() bool {
+	maxDiskBytes := service.config.MaxDiskBytes
+	if maxDiskBytes > 0 && service.queue.GetTotalFileSize() > maxDiskBytes {
+		return true
+	}
+
+	watermark := service.config.DiskUsageWatermark
+	if watermark <= 0 {
+		return false
+	}
+
+	usageRatio, err := service.queue.Storage.UsageRatio(service.queue.FileDir)
+	if err != nil {
+		Logger.Error("Get disk usage error: ", err)
+		return false
+	}
+
+	if usageRatio > watermark {
+		Logger.Warnf("磁盘使用率 %.2f 超过水位 %.2f", usageRatio, watermark)
+		return true
+	}
+
+	return false
+}
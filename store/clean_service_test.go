@@ -0,0 +1,104 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeleteExpiredFiles(t *testing.T) {
+	queue := newTestQueue(t, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(queue)
+
+	//未过期的文件不会被删除
+	if deleted := queue.DeleteExpiredFiles(time.Hour, time.Hour, false, 10); deleted != 0 {
+		t.Fatalf("expect no file deleted, got %d", deleted)
+	}
+
+	//正在被读取的文件不会被删除, 并且之后的文件也不会被删除
+	firstFile := queue.mappedFiles[0]
+	record, err := firstFile.ReadRecord(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted := queue.DeleteExpiredFiles(0, time.Hour, false, 10); deleted != 0 {
+		t.Fatalf("expect no file deleted while reading, got %d", deleted)
+	}
+
+	//文件关闭后读取方仍然可以访问持有的记录, 但是不能再读取新的记录
+	if string(record.Body) != string(testBody(0)) {
+		t.Fatalf("unexpected record body %s", record.Body)
+	}
+	if _, err := firstFile.ReadRecord(0); err != ErrMappedFileUnavailable {
+		t.Fatalf("expect mapped file unavailable, got %v", err)
+	}
+	record.Release()
+
+	if deleted := queue.DeleteExpiredFiles(0, time.Hour, false, 2); deleted != 2 {
+		t.Fatalf("expect 2 files deleted, got %d", deleted)
+	}
+	if _, err := os.Stat(firstFile.FileName); !os.IsNotExist(err) {
+		t.Fatalf("expect %s to be removed, got %v", firstFile.FileName, err)
+	}
+
+	//最后一个文件始终保留
+	if deleted := queue.DeleteExpiredFiles(0, time.Hour, false, 10); deleted != 2 {
+		t.Fatalf("expect 2 files deleted, got %d", deleted)
+	}
+	if queue.GetMinOffset() != 4*queue.FileSize {
+		t.Fatalf("unexpected min offset %d", queue.GetMinOffset())
+	}
+
+	if _, err := queue.ReadAt(0, 1); !errors.Is(err, ErrOffsetDeleted) {
+		t.Fatalf("expect offset deleted, got %v", err)
+	}
+}
+
+func TestCleanWhenExceedMaxDiskBytes(t *testing.T) {
+	queue := newTestQueue(t, 1)
+	queue.Config.DiskUsageWatermark = 0
+	queue.Config.MaxDiskBytes = 3 * queue.FileSize
+	for i := 0; i < 5; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(queue)
+
+	service := NewCleanService(queue, queue.Config)
+	if deleted := service.clean(); deleted != 4 {
+		t.Fatalf("expect 4 files deleted, got %d", deleted)
+	}
+}
+
+func TestDestroyMappedFileForcibly(t *testing.T) {
+	queue := newTestQueue(t, 1)
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	mappedFile := queue.mappedFiles[0]
+	buffer, err := mappedFile.SelectMappedBuffer(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mappedFile.Destroy(time.Hour); err != ErrMappedFileInUse {
+		t.Fatalf("expect mapped file in use, got %v", err)
+	}
+
+	//超过强制删除时间后不再等待读取方释放
+	if err := mappedFile.Destroy(0); err != nil {
+		t.Fatal(err)
+	}
+	if !mappedFile.IsCleanupOver() {
+		t.Fatal("expect mapped file to be cleaned up")
+	}
+	buffer.Release()
+}
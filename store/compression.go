@@ -0,0 +1,170 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CompressionType 记录内容的压缩算法, 压缩之后的记录内容第一个字节为压缩算法, 取值范围为 0-255
+type CompressionType int
+
+const (
+	//CompressionNone 不压缩
+	CompressionNone CompressionType = iota
+
+	//CompressionGzip gzip 压缩
+	CompressionGzip
+
+	//CompressionZlib zlib 压缩
+	CompressionZlib
+
+	//CompressionFlate deflate 压缩, 没有额外的头部与校验和, 压缩之后的数据最短
+	CompressionFlate
+)
+
+var (
+	//ErrUnknownCompression 压缩算法没有注册
+	ErrUnknownCompression = errors.New("unknown compression type")
+
+	//ErrDecompress 记录内容解压失败
+	ErrDecompress = errors.New("decompress record body error")
+)
+
+// CompressionCodec 记录内容的压缩算法, 实现需要支持并发调用
+type CompressionCodec interface {
+	Compress(data []byte) ([]byte, error)
+
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	codecLock sync.RWMutex
+
+	compressionCodecs = map[CompressionType]CompressionCodec{
+		CompressionGzip:  &gzipCodec{},
+		CompressionZlib:  &zlibCodec{},
+		CompressionFlate: &flateCodec{},
+	}
+)
+
+// RegisterCompressionCodec 注册压缩算法, 例如 snappy 与 zstd, 已经注册的算法会被替换
+// 写入方与读取方需要注册相同的算法, 否则读取时返回 ErrUnknownCompression
+func RegisterCompressionCodec(compressionType CompressionType, codec CompressionCodec) error {
+	if compressionType <= CompressionNone || compressionType > 0xff {
+		return fmt.Errorf("%w: %d", ErrUnknownCompression, compressionType)
+	}
+
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	compressionCodecs[compressionType] = codec
+	return nil
+}
+
+// getCompressionCodec 获取已经注册的压缩算法
+func getCompressionCodec(compressionType CompressionType) (CompressionCodec, error) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+
+	codec, ok := compressionCodecs[compressionType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCompression, compressionType)
+	}
+	return codec, nil
+}
+
+func (compressionType CompressionType) String() string {
+	switch compressionType {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZlib:
+		return "zlib"
+	case CompressionFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("compression(%d)", int(compressionType))
+	}
+}
+
+// gzipCodec 标准库的 gzip 压缩
+type gzipCodec struct{}
+
+func (codec *gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (codec *gzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// zlibCodec 标准库的 zlib 压缩
+type zlibCodec struct{}
+
+func (codec *zlibCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (codec *zlibCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// flateCodec 标准库的 deflate 压缩
+type flateCodec struct{}
+
+func (codec *flateCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (codec *flateCodec) Decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,212 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compressibleBody 内容重复、容易压缩的记录内容
+func compressibleBody(i int) []byte {
+	return []byte(strings.Repeat(`{"bookId":1001,"page":`+string(rune('0'+i%10))+`,"content":"turing"}`, 100))
+}
+
+func TestCompressRecord(t *testing.T) {
+	for _, compressionType := range []CompressionType{CompressionGzip, CompressionZlib, CompressionFlate} {
+		body := compressibleBody(1)
+		record := NewRecord(body)
+		record.Topic = "book"
+		if err := record.Compress(compressionType, 1024); err != nil {
+			t.Fatal(err)
+		}
+
+		if record.Compression != compressionType || record.Size() >= recordHeaderSize+len("book")+len(body) {
+			t.Fatalf("expect %s compressed record, got %s with size %d", compressionType, record.Compression, record.Size())
+		}
+
+		data := record.Encode()
+		if len(data) != record.Size() || !bytes.Equal(record.Body, body) {
+			t.Fatalf("unexpected encoded %s record", compressionType)
+		}
+
+		decoded, err := DecodeRecord(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.Compression != compressionType || decoded.Topic != "book" || !bytes.Equal(decoded.Body, body) {
+			t.Fatalf("unexpected decoded %s record %s", compressionType, decoded.Compression)
+		}
+	}
+
+	//内容太短或者压缩之后没有变短时不压缩
+	record := NewRecord(compressibleBody(1))
+	if err := record.Compress(CompressionGzip, 1<<20); err != nil || record.Compression != CompressionNone {
+		t.Fatalf("expect uncompressed record below threshold, got %s, %v", record.Compression, err)
+	}
+
+	record = NewRecord([]byte("book page"))
+	if err := record.Compress(CompressionGzip, 0); err != nil || record.Compression != CompressionNone {
+		t.Fatalf("expect uncompressed record when compression does not help, got %s, %v", record.Compression, err)
+	}
+
+	if err := NewRecord(compressibleBody(1)).Compress(CompressionType(100), 0); !errors.Is(err, ErrUnknownCompression) {
+		t.Fatalf("expect unknown compression, got %v", err)
+	}
+}
+
+// reverseCodec 将内容逆序的压缩算法, 用于测试注册自定义算法
+type reverseCodec struct{}
+
+func (codec *reverseCodec) Compress(data []byte) ([]byte, error) {
+	reversed := make([]byte, 0, len(data)/2)
+	for i := len(data) - 1; i >= len(data)/2; i-- {
+		reversed = append(reversed, data[i])
+	}
+	return reversed, nil
+}
+
+func (codec *reverseCodec) Decompress(data []byte) ([]byte, error) {
+	body := make([]byte, 0, len(data)*2)
+	for i := len(data) - 1; i >= 0; i-- {
+		body = append(body, data[i])
+	}
+	return append(body, body...), nil
+}
+
+func TestRegisterCompressionCodec(t *testing.T) {
+	const compressionType CompressionType = 200
+	record := NewRecord([]byte("pagepage"))
+	if err := record.Compress(compressionType, 0); !errors.Is(err, ErrUnknownCompression) {
+		t.Fatalf("expect unknown compression, got %v", err)
+	}
+
+	if err := RegisterCompressionCodec(compressionType, &reverseCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		codecLock.Lock()
+		delete(compressionCodecs, compressionType)
+		codecLock.Unlock()
+	}()
+
+	if err := record.Compress(compressionType, 0); err != nil || record.Compression != compressionType {
+		t.Fatalf("expect record compressed by registered codec, got %s, %v", record.Compression, err)
+	}
+
+	decoded, err := DecodeRecord(record.Encode())
+	if err != nil || string(decoded.Body) != "pagepage" {
+		t.Fatalf("unexpected decoded record %v", err)
+	}
+
+	if err := RegisterCompressionCodec(CompressionNone, &reverseCodec{}); !errors.Is(err, ErrUnknownCompression) {
+		t.Fatalf("expect register none compression to fail, got %v", err)
+	}
+}
+
+func TestMixedCompressionQueue(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "commitlog")
+	queue := NewMappedFileQueue(dir, 8192)
+	if err := queue.Load(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Recover()
+
+	//先写入没有压缩的记录, 再依次切换压缩算法, 同一个文件中混合不同压缩算法的记录
+	compressionTypes := []CompressionType{CompressionNone, CompressionGzip, CompressionZlib, CompressionFlate}
+	offsets := make([]int64, 0)
+	for i := 0; i < 20; i++ {
+		queue.Config.CompressionType = compressionTypes[i/5]
+		queue.Config.CompressThreshold = 1024
+		result, err := queue.AppendRecord(NewRecord(compressibleBody(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, result.WroteOffset)
+	}
+
+	batchOffsets, err := queue.AppendBatch([][]byte{compressibleBody(20), []byte("short")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets = append(offsets, batchOffsets...)
+
+	queue.Shutdown()
+
+	//重新加载时不需要知道写入时的压缩算法
+	reopened := NewMappedFileQueue(dir, queue.FileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+	defer reopened.Shutdown()
+
+	if reopened.GetMaxOffset() != queue.GetMaxOffset() {
+		t.Fatalf("expect max offset %d, got %d", queue.GetMaxOffset(), reopened.GetMaxOffset())
+	}
+
+	it := reopened.Iterator(0)
+	defer it.Close()
+	count := 0
+	for ; it.Next(); count++ {
+		expected := CompressionFlate
+		body := compressibleBody(count)
+		switch {
+		case count < 20:
+			expected = compressionTypes[count/5]
+		case count == 21:
+			expected, body = CompressionNone, []byte("short")
+		}
+
+		record := it.Record()
+		if it.Offset() != offsets[count] || record.Compression != expected || !bytes.Equal(record.Body, body) {
+			t.Fatalf("unexpected record %d at %d with compression %s", count, it.Offset(), record.Compression)
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 22 {
+		t.Fatalf("expect 22 records, got %d", count)
+	}
+
+	//压缩的记录在文件中的长度小于原始内容
+	if size := offsets[6] - offsets[5]; size >= int64(len(compressibleBody(5))) {
+		t.Fatalf("expect compressed record size less than body, got %d", size)
+	}
+}
+
+func TestCompressedFlagTopicLength(t *testing.T) {
+	queue := NewMappedFileQueue(t.TempDir(), 1<<17)
+
+	//topic 长度的最高位是压缩标记, 超过 maxTopicLength 的 topic 会被当作压缩的记录读取
+	for _, compressionType := range []CompressionType{CompressionNone, CompressionGzip} {
+		queue.Config.CompressionType = compressionType
+		record := NewRecord(compressibleBody(0))
+		record.Topic = strings.Repeat("t", maxTopicLength+1)
+		if _, err := queue.AppendRecord(record); err != ErrTopicTooLong {
+			t.Fatalf("expect %s record topic too long, got %v", compressionType, err)
+		}
+
+		record = NewRecord(compressibleBody(0))
+		record.Topic = strings.Repeat("t", maxTopicLength)
+		result, err := queue.AppendRecord(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := queue.ReadRecord(result.WroteOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if read.Compression != compressionType || read.Topic != record.Topic || !bytes.Equal(read.Body, compressibleBody(0)) {
+			t.Fatalf("unexpected %s record with compression %s", compressionType, read.Compression)
+		}
+		read.Release()
+	}
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"time"
+)
+
+// FlushMode 刷盘方式
+type FlushMode int
+
+const (
+	//AsyncFlush 后台定时刷盘, 写入不等待数据落盘
+	AsyncFlush FlushMode = iota
+
+	//SyncFlush 同步刷盘, 写入需要等待数据落盘后才返回
+	SyncFlush
+)
+
+// QueueConfig MappedFileQueue 的配置
+type QueueConfig struct {
+	//刷盘方式
+	FlushMode FlushMode `mapstructure:"flushMode"`
+
+	//异步刷盘的时间间隔
+	FlushInterval time.Duration `mapstructure:"flushInterval"`
+
+	//异步刷盘时至少需要积累的脏页数量
+	FlushLeastPages int `mapstructure:"flushLeastPages"`
+
+	//超过该时间间隔后无论脏页数量多少都会刷盘
+	FlushThoroughInterval time.Duration `mapstructure:"flushThoroughInterval"`
+
+	//同步刷盘时写入等待的超时时间
+	SyncFlushTimeout time.Duration `mapstructure:"syncFlushTimeout"`
+
+	//文件最后修改时间超过该时长后会被删除
+	FileReservedTime time.Duration `mapstructure:"fileReservedTime"`
+
+	//所有文件占用的最大磁盘空间, 0表示不限制
+	MaxDiskBytes int64 `mapstructure:"maxDiskBytes"`
+
+	//磁盘使用率超过该水位后不考虑文件的保留时间立即删除
+	DiskUsageWatermark float64 `mapstructure:"diskUsageWatermark"`
+
+	//清理过期文件的时间间隔
+	CleanInterval time.Duration `mapstructure:"cleanInterval"`
+
+	//每次清理最多删除的文件数量
+	DeleteFilesBatchMax int `mapstructure:"deleteFilesBatchMax"`
+
+	//切换文件时在后台预先创建的文件数量, 0表示不预先创建
+	PreAllocateCount int `mapstructure:"preAllocateCount"`
+
+	//创建文件时是否预热, 预先分配磁盘空间并逐页写入
+	WarmMappedFile bool `mapstructure:"warmMappedFile"`
+
+	//预热时每写入多少个内存页让出一次CPU
+	WarmUpYieldPages int `mapstructure:"warmUpYieldPages"`
+
+	//预热时是否通知内核预读文件
+	MadviseWillNeed bool `mapstructure:"madviseWillNeed"`
+
+	//预热后是否锁定内存, 避免被换出
+	MlockMappedFile bool `mapstructure:"mlockMappedFile"`
+
+	//是否启用写入缓冲池, 写入方先写入缓冲区再由提交协程拷贝到映射区域, 只在异步刷盘时生效
+	TransientStorePoolEnable bool `mapstructure:"transientStorePoolEnable"`
+
+	//写入缓冲池中缓冲区的数量
+	TransientStorePoolSize int `mapstructure:"transientStorePoolSize"`
+
+	//提交写入缓冲区的时间间隔
+	CommitInterval time.Duration `mapstructure:"commitInterval"`
+
+	//提交时至少需要积累的内存页数量
+	CommitLeastPages int `mapstructure:"commitLeastPages"`
+
+	//超过该时间间隔后无论内存页数量多少都会提交
+	CommitThoroughInterval time.Duration `mapstructure:"commitThoroughInterval"`
+
+	//写入锁的类型
+	PutLockType PutLockType `mapstructure:"putLockType"`
+
+	//删除文件时等待读取方释放引用的最长时间, 超过后强制删除
+	DestroyIntervalForcibly time.Duration `mapstructure:"destroyIntervalForcibly"`
+
+	//写入记录时使用的压缩算法, 修改之后已经写入的记录仍然可以读取
+	CompressionType CompressionType `mapstructure:"compressionType"`
+
+	//记录内容超过该长度时才压缩
+	CompressThreshold int `mapstructure:"compressThreshold"`
+}
+
+// DefaultQueueConfig 默认配置
+func DefaultQueueConfig() *QueueConfig {
+	return &QueueConfig{
+		FlushMode:                AsyncFlush,
+		FlushInterval:            500 * time.Millisecond,
+		FlushLeastPages:          4,
+		FlushThoroughInterval:    10 * time.Second,
+		SyncFlushTimeout:         5 * time.Second,
+		FileReservedTime:         72 * time.Hour,
+		MaxDiskBytes:             0,
+		DiskUsageWatermark:       0.75,
+		CleanInterval:            10 * time.Second,
+		DeleteFilesBatchMax:      10,
+		PreAllocateCount:         1,
+		WarmMappedFile:           false,
+		WarmUpYieldPages:         1024,
+		MadviseWillNeed:          false,
+		MlockMappedFile:          false,
+		TransientStorePoolEnable: false,
+		TransientStorePoolSize:   5,
+		CommitInterval:           200 * time.Millisecond,
+		CommitLeastPages:         4,
+		CommitThoroughInterval:   200 * time.Millisecond,
+		PutLockType:              MutexPutLock,
+		DestroyIntervalForcibly:  120 * time.Second,
+		CompressionType:          CompressionNone,
+		CompressThreshold:        4096,
+	}
+}
+
+// StoreConfig MessageStore 的配置
+type StoreConfig struct {
+	//commit log 单个文件的大小
+	CommitLogFileSize int64 `mapstructure:"commitLogFileSize"`
+
+	//每个消费队列文件包含的索引条目数量
+	ConsumeQueueEntriesPerFile int `mapstructure:"consumeQueueEntriesPerFile"`
+
+	//消费队列刷盘的时间间隔
+	FlushConsumeQueueInterval time.Duration `mapstructure:"flushConsumeQueueInterval"`
+
+	//消费队列刷盘时至少需要积累的脏页数量
+	FlushConsumeQueueLeastPages int `mapstructure:"flushConsumeQueueLeastPages"`
+
+	//超过该时间间隔后无论脏页数量多少都会将消费队列刷盘
+	FlushConsumeQueueThoroughInterval time.Duration `mapstructure:"flushConsumeQueueThoroughInterval"`
+
+	//分发协程检查 commit log 新数据的时间间隔, 有新数据写入时会立即唤醒分发协程
+	ReputInterval time.Duration `mapstructure:"reputInterval"`
+
+	//消费进度持久化的时间间隔
+	FlushConsumerOffsetInterval time.Duration `mapstructure:"flushConsumerOffsetInterval"`
+
+	//是否根据记录的业务主键构建哈希索引
+	MessageIndexEnable bool `mapstructure:"messageIndexEnable"`
+
+	//每个索引文件的哈希槽数量
+	IndexHashSlotNum int `mapstructure:"indexHashSlotNum"`
+
+	//每个索引文件最多包含的索引条目数量
+	IndexNum int `mapstructure:"indexNum"`
+
+	//每个索引文件保存的时间窗口, 超过后创建新的索引文件
+	IndexFileTimeWindow time.Duration `mapstructure:"indexFileTimeWindow"`
+
+	//延迟级别对应的延迟时长, 使用空格分隔, 第 i 个时长对应级别 i
+	MessageDelayLevel string `mapstructure:"messageDelayLevel"`
+
+	//检查延迟记录是否到期的时间间隔
+	ScheduleInterval time.Duration `mapstructure:"scheduleInterval"`
+
+	//commit log 的配置
+	CommitLog *QueueConfig `mapstructure:"commitLog"`
+
+	//所有文件的存储后端, 包括 commit log、消费队列、索引文件与消费进度, 为nil时使用内存映射
+	Storage Storage `mapstructure:"-"`
+}
+
+// DefaultStoreConfig 默认配置
+func DefaultStoreConfig() *StoreConfig {
+	return &StoreConfig{
+		CommitLogFileSize:                 1 << 30,
+		ConsumeQueueEntriesPerFile:        300000,
+		FlushConsumeQueueInterval:         time.Second,
+		FlushConsumeQueueLeastPages:       2,
+		FlushConsumeQueueThoroughInterval: 60 * time.Second,
+		ReputInterval:                     10 * time.Millisecond,
+		FlushConsumerOffsetInterval:       5 * time.Second,
+		MessageIndexEnable:                true,
+		IndexHashSlotNum:                  500000,
+		IndexNum:                          2000000,
+		IndexFileTimeWindow:               time.Hour,
+		MessageDelayLevel:                 "1s 5s 10s 30s 1m 2m 3m 4m 5m 6m 7m 8m 9m 10m 20m 30m 1h 2h",
+		ScheduleInterval:                  100 * time.Millisecond,
+		CommitLog:                         DefaultQueueConfig(),
+	}
+}
@@ -0,0 +1,271 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	//ConsumeQueueEntrySize 索引条目长度: commitLogOffset(8) + size(4) + tagsCode(8)
+	ConsumeQueueEntrySize = 8 + 4 + 8
+
+	//blankEntrySize 空白条目的记录长度, 用于填补索引中缺失的位置
+	blankEntrySize int32 = math.MaxInt32
+)
+
+var (
+	//ErrBlankEntry 索引位置是填补的空白条目, 没有对应的记录
+	ErrBlankEntry = errors.New("blank consume queue entry")
+)
+
+// ConsumeQueueEntry 消费队列中的一个索引条目, 指向 commit log 中的一条记录
+type ConsumeQueueEntry struct {
+	//记录在 commit log 中的偏移量
+	CommitLogOffset int64
+
+	//记录的长度
+	Size int32
+
+	//记录标签的哈希值
+	TagsCode int64
+}
+
+// ConsumeQueue 消费队列, 按照写入顺序保存某个 topic 下某个队列中所有记录的索引
+// 每个条目的长度固定, 第N条记录的索引位于 N*ConsumeQueueEntrySize, 可以直接定位
+type ConsumeQueue struct {
+	Topic string
+
+	QueueId int32
+
+	//保存索引条目的文件队列
+	queue *MappedFileQueue
+
+	//已经写入索引的记录在 commit log 中的最大结束位置, 只在分发协程中访问
+	maxPhysicOffset int64
+}
+
+// NewConsumeQueue 创建消费队列, 文件保存在 storage 中的 rootDir/topic/queueId 目录下
+func NewConsumeQueue(storage Storage, rootDir string, topic string, queueId int32, entriesPerFile int) *ConsumeQueue {
+	fileDir := filepath.Join(rootDir, topic, strconv.Itoa(int(queueId)))
+	queue := NewMappedFileQueue(fileDir, int64(entriesPerFile*ConsumeQueueEntrySize))
+	queue.Storage = storage
+	return &ConsumeQueue{
+		Topic:   topic,
+		QueueId: queueId,
+		queue:   queue,
+	}
+}
+
+// Load 加载已经存在的索引文件
+func (cq *ConsumeQueue) Load() error {
+	return cq.queue.Load()
+}
+
+// Recover 找到最后一个有效的索引条目, 之后的数据都会被截断
+// 索引条目是连续写入的, 之前的文件都已经写满, 只需要校验最后一个文件
+func (cq *ConsumeQueue) Recover() {
+	lastFile := cq.queue.getLastFile()
+	if lastFile == nil {
+		return
+	}
+
+	region := lastFile.region.Bytes()
+	var position int64 = 0
+	for ; position+ConsumeQueueEntrySize <= lastFile.FileSize; position += ConsumeQueueEntrySize {
+		if decodeConsumeQueueEntry(region[position:position+ConsumeQueueEntrySize]).Size == 0 {
+			break
+		}
+	}
+
+	cq.queue.truncateTo(lastFile.fileFromOffset + position)
+	cq.maxPhysicOffset = cq.lastPhysicOffset()
+	Logger.Infof("恢复ConsumeQueue %s-%d 完成, 最大偏移量: %d", cq.Topic, cq.QueueId, cq.GetMaxOffsetInQueue())
+}
+
+// TruncateDirtyEntries 删除指向 commit log 中 phyOffset 之后的索引条目, commit log 截断之后调用
+func (cq *ConsumeQueue) TruncateDirtyEntries(phyOffset int64) {
+	minOffset, maxOffset := cq.GetMinOffsetInQueue(), cq.GetMaxOffsetInQueue()
+
+	offset := maxOffset
+	for ; offset > minOffset; offset-- {
+		entry, err := cq.GetEntry(offset - 1)
+		if err != nil || entry.CommitLogOffset+int64(entry.Size) <= phyOffset {
+			break
+		}
+	}
+
+	if offset < maxOffset {
+		Logger.Warnf("ConsumeQueue %s-%d 截断到偏移量: %d", cq.Topic, cq.QueueId, offset)
+		cq.queue.truncateTo(offset * ConsumeQueueEntrySize)
+		cq.maxPhysicOffset = cq.lastPhysicOffset()
+	}
+}
+
+// lastPhysicOffset 最后一个有效索引条目指向的记录在 commit log 中的结束位置, 没有有效的条目时为0
+func (cq *ConsumeQueue) lastPhysicOffset() int64 {
+	for offset := cq.GetMaxOffsetInQueue() - 1; offset >= cq.GetMinOffsetInQueue(); offset-- {
+		entry, err := cq.GetEntry(offset)
+		if errors.Is(err, ErrBlankEntry) {
+			continue
+		}
+
+		if err != nil {
+			Logger.Error("Read consume queue entry error: ", err)
+			return 0
+		}
+		return entry.CommitLogOffset + int64(entry.Size)
+	}
+
+	return 0
+}
+
+// GetMaxPhysicOffset 已经写入索引的记录在 commit log 中的最大结束位置
+func (cq *ConsumeQueue) GetMaxPhysicOffset() int64 {
+	return cq.maxPhysicOffset
+}
+
+// PutEntry 写入第 queueOffset 条记录的索引
+// 已经写入过的位置直接忽略, 中间缺失的位置使用空白条目填补
+func (cq *ConsumeQueue) PutEntry(queueOffset int64, commitLogOffset int64, size int32, tagsCode int64) error {
+	expectOffset := cq.GetMaxOffsetInQueue()
+	if queueOffset < expectOffset {
+		return nil
+	}
+
+	if queueOffset > expectOffset {
+		Logger.Warnf("ConsumeQueue %s-%d 缺少偏移量 %d 到 %d 的索引, 使用空白条目填补", cq.Topic, cq.QueueId, expectOffset, queueOffset)
+	}
+
+	for ; expectOffset < queueOffset; expectOffset++ {
+		if err := cq.appendEntry(&ConsumeQueueEntry{Size: blankEntrySize}); err != nil {
+			return err
+		}
+	}
+
+	err := cq.appendEntry(&ConsumeQueueEntry{
+		CommitLogOffset: commitLogOffset,
+		Size:            size,
+		TagsCode:        tagsCode,
+	})
+	if err != nil {
+		return err
+	}
+
+	cq.maxPhysicOffset = commitLogOffset + int64(size)
+	return nil
+}
+
+// appendEntry 在队列末尾追加索引条目, 文件大小是条目长度的整数倍, 文件写满之后切换到下一个文件
+func (cq *ConsumeQueue) appendEntry(entry *ConsumeQueueEntry) error {
+	mappedFile, err := cq.queue.GetLastMappedFile(true)
+	if err != nil {
+		return err
+	}
+
+	_, err = mappedFile.Append(entry.encode())
+	return err
+}
+
+// GetEntry 获取第 queueOffset 条记录的索引
+func (cq *ConsumeQueue) GetEntry(queueOffset int64) (*ConsumeQueueEntry, error) {
+	position := queueOffset * ConsumeQueueEntrySize
+	mappedFile, err := cq.queue.FindMappedFileByOffset(position)
+	if err != nil {
+		return nil, err
+	}
+
+	data := mappedFile.ReadBytes(position-mappedFile.fileFromOffset, ConsumeQueueEntrySize)
+	if len(data) < ConsumeQueueEntrySize {
+		return nil, ErrNoMoreRecord
+	}
+
+	entry := decodeConsumeQueueEntry(data)
+	if entry.Size == blankEntrySize {
+		return nil, ErrBlankEntry
+	}
+	return entry, nil
+}
+
+// GetMaxOffsetInQueue 下一条记录在队列中的偏移量
+func (cq *ConsumeQueue) GetMaxOffsetInQueue() int64 {
+	return cq.queue.GetMaxOffset() / ConsumeQueueEntrySize
+}
+
+// GetMinOffsetInQueue 队列中第一条没有被删除的记录的偏移量
+func (cq *ConsumeQueue) GetMinOffsetInQueue() int64 {
+	return cq.queue.GetMinOffset() / ConsumeQueueEntrySize
+}
+
+// minOffsetInQueueFrom 第一条在 commit log 中的偏移量不小于 minPhysicOffset 的记录在队列中的偏移量
+// commit log 的文件被删除之后之前的索引条目不再有效, 索引条目中的 commit log 偏移量单调递增, 因此可以二分查找
+func (cq *ConsumeQueue) minOffsetInQueueFrom(minPhysicOffset int64) int64 {
+	low, high := cq.GetMinOffsetInQueue(), cq.GetMaxOffsetInQueue()
+	for low < high {
+		middle := low + (high-low)/2
+		if cq.isBeforePhysicOffset(middle, minPhysicOffset) {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	return low
+}
+
+// isBeforePhysicOffset queueOffset 位置的记录是否位于 commit log 的 minPhysicOffset 之前
+// 空白条目没有对应的记录, 使用之后第一个有效条目判断
+func (cq *ConsumeQueue) isBeforePhysicOffset(queueOffset int64, minPhysicOffset int64) bool {
+	for maxOffset := cq.GetMaxOffsetInQueue(); queueOffset < maxOffset; queueOffset++ {
+		entry, err := cq.GetEntry(queueOffset)
+		if errors.Is(err, ErrBlankEntry) {
+			continue
+		}
+
+		if err != nil {
+			return false
+		}
+		return entry.CommitLogOffset < minPhysicOffset
+	}
+
+	return false
+}
+
+// Flush 将索引文件的脏页刷盘, 返回是否有数据被刷盘
+func (cq *ConsumeQueue) Flush(flushLeastPages int) bool {
+	return cq.queue.Flush(flushLeastPages)
+}
+
+// Shutdown 将所有索引刷盘并关闭检查点
+func (cq *ConsumeQueue) Shutdown() {
+	cq.queue.Shutdown()
+}
+
+func (entry *ConsumeQueueEntry) encode() []byte {
+	buffer := make([]byte, ConsumeQueueEntrySize)
+	binary.BigEndian.PutUint64(buffer[0:8], uint64(entry.CommitLogOffset))
+	binary.BigEndian.PutUint32(buffer[8:12], uint32(entry.Size))
+	binary.BigEndian.PutUint64(buffer[12:20], uint64(entry.TagsCode))
+	return buffer
+}
+
+func decodeConsumeQueueEntry(data []byte) *ConsumeQueueEntry {
+	return &ConsumeQueueEntry{
+		CommitLogOffset: int64(binary.BigEndian.Uint64(data[0:8])),
+		Size:            int32(binary.BigEndian.Uint32(data[8:12])),
+		TagsCode:        int64(binary.BigEndian.Uint64(data[12:20])),
+	}
+}
+
+// tagsCodeOf 计算标签的哈希值, 没有标签时为0
+func tagsCodeOf(tags string) int64 {
+	if tags == "" {
+		return 0
+	}
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(tags))
+	return int64(hash.Sum64())
+}
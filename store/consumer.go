@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	//ErrIllegalMaxNums 拉取的最大记录数量必须大于0
+	ErrIllegalMaxNums = errors.New("max nums must be positive")
+)
+
+// PullResult 一次拉取的结果
+type PullResult struct {
+	//拉取到的记录, 使用完成后需要调用 Release
+	Records []*Record
+
+	//下一次拉取的队列偏移量, 消费完成后提交该偏移量
+	NextOffset int64
+}
+
+// Release 释放所有记录对文件的引用
+func (result *PullResult) Release() {
+	for _, record := range result.Records {
+		record.Release()
+	}
+	result.Records = nil
+}
+
+// Consumer 消费组中的消费者, 从消费组提交的进度开始拉取 topic 下指定队列中的记录
+// 拉取不会自动提交进度, 消费完成后需要调用 Commit, 没有提交的记录会被再次拉取
+type Consumer struct {
+	Group string
+
+	Topic string
+
+	store *MessageStore
+}
+
+// NewConsumer 创建消费者, 同一个消费组中的消费者共享消费进度
+func (this *MessageStore) NewConsumer(group string, topic string) *Consumer {
+	return &Consumer{
+		Group: group,
+		Topic: topic,
+		store: this,
+	}
+}
+
+// Pull 从消费进度开始拉取最多 maxNums 条记录
+// 没有新记录时阻塞等待, 直到有新的记录写入或者 ctx 结束, ctx 结束时返回空的结果
+func (consumer *Consumer) Pull(ctx context.Context, queueId int32, maxNums int) (*PullResult, error) {
+	if maxNums <= 0 {
+		return nil, ErrIllegalMaxNums
+	}
+
+	for {
+		//先获取通知再读取, 避免读取之后写入的记录错过通知
+		arriving := consumer.store.reputService.arrivingNotify()
+
+		result, err := consumer.pullOnce(queueId, maxNums)
+		if err != nil || len(result.Records) > 0 {
+			return result, err
+		}
+
+		select {
+		case <-arriving:
+		case <-ctx.Done():
+			return result, nil
+		}
+	}
+}
+
+// pullOnce 读取消费进度之后已经构建索引的记录
+func (consumer *Consumer) pullOnce(queueId int32, maxNums int) (*PullResult, error) {
+	offset := consumer.currentOffset(queueId)
+	result := &PullResult{
+		Records:    make([]*Record, 0),
+		NextOffset: offset,
+	}
+
+	maxOffset := consumer.store.GetMaxOffsetInQueue(consumer.Topic, queueId)
+	for ; offset < maxOffset && len(result.Records) < maxNums; offset++ {
+		record, err := consumer.store.GetRecord(consumer.Topic, queueId, offset)
+		if errors.Is(err, ErrBlankEntry) {
+			continue
+		}
+
+		if err != nil {
+			result.Release()
+			return nil, err
+		}
+		result.Records = append(result.Records, record)
+	}
+
+	result.NextOffset = offset
+	return result, nil
+}
+
+// currentOffset 消费组当前的消费进度, 没有提交过或者记录已经被删除时从最早的记录开始
+func (consumer *Consumer) currentOffset(queueId int32) int64 {
+	offset := consumer.store.offsetManager.QueryOffset(consumer.Group, consumer.Topic, queueId)
+	if minOffset := consumer.store.GetMinOffsetInQueue(consumer.Topic, queueId); offset < minOffset {
+		offset = minOffset
+	}
+	return offset
+}
+
+// Commit 提交消费进度, offset 为下一条需要消费的记录的队列偏移量
+func (consumer *Consumer) Commit(queueId int32, offset int64) {
+	consumer.store.offsetManager.CommitOffset(consumer.Group, consumer.Topic, queueId, offset)
+}
+
+// ResetToEarliest 将消费进度重置到最早的记录
+func (consumer *Consumer) ResetToEarliest(queueId int32) {
+	consumer.Commit(queueId, consumer.store.GetMinOffsetInQueue(consumer.Topic, queueId))
+}
+
+// ResetToLatest 将消费进度重置到最新的位置, 只消费之后写入的记录
+func (consumer *Consumer) ResetToLatest(queueId int32) {
+	consumer.Commit(queueId, consumer.store.GetMaxOffsetInQueue(consumer.Topic, queueId))
+}
+
+// ResetToTimestamp 将消费进度重置到第一条写入时间不早于 timestamp 的记录
+func (consumer *Consumer) ResetToTimestamp(queueId int32, timestamp int64) error {
+	offset, err := consumer.store.GetOffsetInQueueByTime(consumer.Topic, queueId, timestamp)
+	if err != nil {
+		return err
+	}
+
+	consumer.Commit(queueId, offset)
+	return nil
+}
+
+// Lag 队列中还没有被消费组消费的记录数量
+func (consumer *Consumer) Lag(queueId int32) int64 {
+	return consumer.store.GetMaxOffsetInQueue(consumer.Topic, queueId) - consumer.currentOffset(queueId)
+}
+
+// TotalLag topic 下所有队列中还没有被消费组消费的记录数量
+func (consumer *Consumer) TotalLag() int64 {
+	var lag int64 = 0
+	for _, queueId := range consumer.store.getQueueIds(consumer.Topic) {
+		lag += consumer.Lag(queueId)
+	}
+	return lag
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	//consumerOffsetFileName 消费进度文件, 保存在 rootDir/config 目录下
+	consumerOffsetFileName = "consumerOffset.json"
+)
+
+// ConsumerOffsetManager 保存每个消费组在每个队列上的消费进度, 定时持久化到 JSON 文件
+type ConsumerOffsetManager struct {
+	FileName string
+
+	//消费进度文件所在的存储后端
+	storage Storage
+
+	//持久化的时间间隔
+	interval time.Duration
+
+	lock sync.RWMutex
+
+	//保证同一时刻只有一个协程在写入文件
+	persistLock sync.Mutex
+
+	//group@topic -> queueId -> 下一条需要消费的记录的队列偏移量
+	offsetTable map[string]map[int32]int64
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+}
+
+func NewConsumerOffsetManager(storage Storage, fileName string, interval time.Duration) *ConsumerOffsetManager {
+	return &ConsumerOffsetManager{
+		FileName:    fileName,
+		storage:     storage,
+		interval:    interval,
+		offsetTable: make(map[string]map[int32]int64),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// Load 从文件中加载消费进度, 文件不存在或者无法解析时尝试从备份文件中加载
+func (manager *ConsumerOffsetManager) Load() error {
+	offsetTable, err := manager.readOffsetTable(manager.FileName)
+	if err != nil {
+		backupTable, backupErr := manager.readOffsetTable(manager.FileName + ".bak")
+		switch {
+		case backupErr == nil:
+			if !os.IsNotExist(err) {
+				Logger.Warnf("加载消费进度失败: %v, 使用备份文件中的消费进度", err)
+			}
+			offsetTable = backupTable
+		case !os.IsNotExist(err):
+			return err
+		case !os.IsNotExist(backupErr):
+			return backupErr
+		default:
+			return nil
+		}
+	}
+
+	manager.lock.Lock()
+	manager.offsetTable = offsetTable
+	manager.lock.Unlock()
+	return nil
+}
+
+// readOffsetTable 读取并解析消费进度文件
+func (manager *ConsumerOffsetManager) readOffsetTable(fileName string) (map[string]map[int32]int64, error) {
+	data, err := manager.storage.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	offsetTable := make(map[string]map[int32]int64)
+	if err := json.Unmarshal(data, &offsetTable); err != nil {
+		return nil, fmt.Errorf("decode consumer offset file %s: %w", fileName, err)
+	}
+	return offsetTable, nil
+}
+
+// Persist 将消费进度写入文件, 先写入临时文件再替换, 替换前保留一份备份
+func (manager *ConsumerOffsetManager) Persist() error {
+	manager.persistLock.Lock()
+	defer manager.persistLock.Unlock()
+
+	manager.lock.RLock()
+	data, err := json.MarshalIndent(manager.offsetTable, "", "  ")
+	manager.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := manager.storage.MkdirAll(filepath.Dir(manager.FileName)); err != nil {
+		return err
+	}
+
+	tmpFileName := manager.FileName + ".tmp"
+	if err := manager.storage.WriteFile(tmpFileName, data); err != nil {
+		return err
+	}
+
+	if _, err := manager.storage.Stat(manager.FileName); err == nil {
+		if err := manager.storage.Rename(manager.FileName, manager.FileName+".bak"); err != nil {
+			return err
+		}
+	}
+
+	return manager.storage.Rename(tmpFileName, manager.FileName)
+}
+
+// CommitOffset 提交消费组在队列上的消费进度, offset 为下一条需要消费的记录的队列偏移量
+func (manager *ConsumerOffsetManager) CommitOffset(group string, topic string, queueId int32, offset int64) {
+	key := consumerOffsetKey(group, topic)
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if manager.offsetTable[key] == nil {
+		manager.offsetTable[key] = make(map[int32]int64)
+	}
+	manager.offsetTable[key][queueId] = offset
+}
+
+// QueryOffset 查询消费组在队列上的消费进度, 没有提交过时返回-1
+func (manager *ConsumerOffsetManager) QueryOffset(group string, topic string, queueId int32) int64 {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	offset, ok := manager.offsetTable[consumerOffsetKey(group, topic)][queueId]
+	if !ok {
+		return -1
+	}
+	return offset
+}
+
+// Start 启动定时持久化
+func (manager *ConsumerOffsetManager) Start() {
+	manager.waitGroup.Add(1)
+	go manager.run()
+}
+
+// Shutdown 停止定时持久化, 停止前持久化一次
+func (manager *ConsumerOffsetManager) Shutdown() {
+	close(manager.stopCh)
+	manager.waitGroup.Wait()
+
+	if err := manager.Persist(); err != nil {
+		Logger.Error("Persist consumer offset error: ", err)
+	}
+}
+
+func (manager *ConsumerOffsetManager) run() {
+	defer manager.waitGroup.Done()
+
+	ticker := time.NewTicker(manager.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-manager.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := manager.Persist(); err != nil {
+			Logger.Error("Persist consumer offset error: ", err)
+		}
+	}
+}
+
+func consumerOffsetKey(group string, topic string) string {
+	return group + "@" + topic
+}
@@ -0,0 +1,252 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConsumerPullAndCommit(t *testing.T) {
+	rootDir := t.TempDir()
+	store := newTestMessageStore(t, rootDir)
+
+	for i := 0; i < 10; i++ {
+		if _, err := store.PutRecord(newTestTopicRecord("book", 0, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForDispatch(t, store)
+
+	consumer := store.NewConsumer("reader", "book")
+	if _, err := consumer.Pull(context.Background(), 0, 0); err != ErrIllegalMaxNums {
+		t.Fatalf("expect illegal max nums, got %v", err)
+	}
+
+	result, err := consumer.Pull(context.Background(), 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 4 || result.NextOffset != 4 {
+		t.Fatalf("expect 4 records and next offset 4, got %d records and next offset %d", len(result.Records), result.NextOffset)
+	}
+
+	for i, record := range result.Records {
+		if !bytes.Equal(record.Body, testBody(i)) {
+			t.Fatalf("unexpected record %d", i)
+		}
+	}
+	result.Release()
+
+	//没有提交时再次拉取到相同的记录
+	result, err = consumer.Pull(context.Background(), 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Release()
+
+	if result.NextOffset != 4 {
+		t.Fatalf("expect next offset 4, got %d", result.NextOffset)
+	}
+
+	consumer.Commit(0, result.NextOffset)
+	if lag := consumer.Lag(0); lag != 6 {
+		t.Fatalf("expect lag 6, got %d", lag)
+	}
+	store.Shutdown()
+
+	//重启之后从提交的进度继续消费
+	store = newTestMessageStore(t, rootDir)
+	defer store.Shutdown()
+
+	consumer = store.NewConsumer("reader", "book")
+	result, err = consumer.Pull(context.Background(), 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+
+	if len(result.Records) != 6 || !bytes.Equal(result.Records[0].Body, testBody(4)) {
+		t.Fatalf("expect 6 records starting from 4, got %d records", len(result.Records))
+	}
+
+	//其他消费组的进度互不影响
+	if lag := store.NewConsumer("writer", "book").Lag(0); lag != 10 {
+		t.Fatalf("expect lag 10 for another group, got %d", lag)
+	}
+}
+
+func TestConsumerLongPolling(t *testing.T) {
+	store := newTestMessageStore(t, t.TempDir())
+	defer store.Shutdown()
+
+	if _, err := store.PutRecord(newTestTopicRecord("book", 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	waitForDispatch(t, store)
+
+	consumer := store.NewConsumer("reader", "book")
+	consumer.ResetToLatest(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	result, err := consumer.Pull(ctx, 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 0 || result.NextOffset != 1 {
+		t.Fatalf("expect empty result at offset 1, got %d records at %d", len(result.Records), result.NextOffset)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := store.PutRecord(newTestTopicRecord("book", 0, 1)); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err = consumer.Pull(ctx, 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+
+	if len(result.Records) != 1 || !bytes.Equal(result.Records[0].Body, testBody(1)) {
+		t.Fatalf("expect the record written while waiting, got %d records", len(result.Records))
+	}
+}
+
+func TestConsumerResetOffset(t *testing.T) {
+	store := newTestMessageStore(t, t.TempDir())
+	defer store.Shutdown()
+
+	var baseTimestamp int64 = 1_000_000
+	for i := 0; i < 20; i++ {
+		record := newTestTopicRecord("book", int32(i%2), i)
+		record.StoreTimestamp = baseTimestamp + int64(i)*10
+		if _, err := store.PutRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForDispatch(t, store)
+
+	consumer := store.NewConsumer("reader", "book")
+	if lag := consumer.TotalLag(); lag != 20 {
+		t.Fatalf("expect total lag 20, got %d", lag)
+	}
+
+	consumer.ResetToLatest(0)
+	if lag := consumer.TotalLag(); lag != 10 {
+		t.Fatalf("expect total lag 10, got %d", lag)
+	}
+
+	//队列 1 中第 3 条记录的写入时间为 baseTimestamp+70
+	if err := consumer.ResetToTimestamp(1, baseTimestamp+65); err != nil {
+		t.Fatal(err)
+	}
+
+	if lag := consumer.Lag(1); lag != 7 {
+		t.Fatalf("expect lag 7, got %d", lag)
+	}
+
+	consumer.ResetToEarliest(0)
+	if lag := consumer.Lag(0); lag != 10 {
+		t.Fatalf("expect lag 10, got %d", lag)
+	}
+}
+
+func TestConsumerSkipDeletedRecords(t *testing.T) {
+	store := newTestMessageStore(t, t.TempDir())
+	defer store.Shutdown()
+
+	offsets := make([]int64, 0, 100)
+	for i := 0; i < 100; i++ {
+		result, err := store.PutRecord(newTestTopicRecord("book", 0, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, result.WroteOffset)
+	}
+	waitForDispatch(t, store)
+	flushAll(store.CommitLog)
+
+	//删除 commit log 中除最后一个文件之外的所有文件, 消费队列中的索引条目仍然存在
+	if deleted := store.CommitLog.DeleteExpiredFiles(0, time.Hour, true, 10); deleted == 0 {
+		t.Fatal("expect commit log files deleted")
+	}
+
+	firstAlive := 0
+	for offsets[firstAlive] < store.CommitLog.GetMinOffset() {
+		firstAlive++
+	}
+
+	consumer := store.NewConsumer("reader", "book")
+	if lag := consumer.Lag(0); lag != int64(100-firstAlive) {
+		t.Fatalf("expect lag %d, got %d", 100-firstAlive, lag)
+	}
+
+	result, err := consumer.Pull(context.Background(), 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+
+	if len(result.Records) != 100-firstAlive || result.NextOffset != 100 {
+		t.Fatalf("expect %d records and next offset 100, got %d records and next offset %d", 100-firstAlive, len(result.Records), result.NextOffset)
+	}
+
+	if !bytes.Equal(result.Records[0].Body, testBody(firstAlive)) {
+		t.Fatalf("expect first record %d", firstAlive)
+	}
+
+	//按照时间重置时不会读取已经被删除的记录
+	if err := consumer.ResetToTimestamp(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if lag := consumer.Lag(0); lag != int64(100-firstAlive) {
+		t.Fatalf("expect lag %d after reset to timestamp, got %d", 100-firstAlive, lag)
+	}
+}
+
+func TestConsumerOffsetLoadBackup(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), consumerOffsetFileName)
+	manager := NewConsumerOffsetManager(defaultStorage, fileName, time.Second)
+	for _, offset := range []int64{3, 5} {
+		manager.CommitOffset("reader", "book", 0, offset)
+		if err := manager.Persist(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//消费进度文件损坏时使用备份文件中上一次持久化的进度
+	if err := os.WriteFile(fileName, []byte("{\"reader@book\":"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewConsumerOffsetManager(defaultStorage, fileName, time.Second)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if offset := reloaded.QueryOffset("reader", "book", 0); offset != 3 {
+		t.Fatalf("expect offset 3 from backup file, got %d", offset)
+	}
+
+	//备份文件也无法使用时返回错误
+	if err := os.WriteFile(fileName+".bak", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewConsumerOffsetManager(defaultStorage, fileName, time.Second).Load(); err == nil {
+		t.Fatal("expect corrupt consumer offset files to fail loading")
+	}
+}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/afero"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+const (
+	//crashFileSize 崩溃测试中每个文件的大小, 记录长度随机, 文件末尾经常需要写入结束标记
+	crashFileSize = 1024
+
+	//crashSectorSize 模拟崩溃时数据写回的最小单位, 同一个扇区中的数据要么全部写回要么全部丢失
+	crashSectorSize = 64
+)
+
+// crashFault 模拟崩溃时没有刷盘的数据的处理方式
+type crashFault int
+
+const (
+	//faultDropUnflushed 没有刷盘的数据全部丢失
+	faultDropUnflushed crashFault = iota
+
+	//faultTornTail 没有刷盘的数据只写回了前面一部分, 最后一条记录可能不完整
+	faultTornTail
+
+	//faultRandomSectors 没有刷盘的数据以扇区为单位乱序写回, 中间可能出现空洞
+	faultRandomSectors
+
+	//faultZeroSectors 没有刷盘的区域中随机的扇区被清零
+	faultZeroSectors
+
+	crashFaultCount
+)
+
+// crashRecord 写入成功的记录
+type crashRecord struct {
+	offset int64
+
+	body []byte
+}
+
+func (record *crashRecord) end() int64 {
+	return record.offset + int64(recordHeaderSize+len(record.body))
+}
+
+// crashHarness 在内存中的存储上运行随机的写入、刷盘与切换文件, 在任意位置模拟崩溃并校验恢复结果
+type crashHarness struct {
+	t *testing.T
+
+	random *rand.Rand
+
+	fs afero.Fs
+
+	storage *HeapStorage
+
+	queue *MappedFileQueue
+
+	//所有写入成功并且没有在崩溃中丢失的记录, 按照偏移量排序
+	records []*crashRecord
+}
+
+func newCrashHarness(t *testing.T, seed int64) *crashHarness {
+	fs := afero.NewMemMapFs()
+	return &crashHarness{
+		t:       t,
+		random:  rand.New(rand.NewSource(seed)),
+		fs:      fs,
+		storage: NewHeapStorage(fs),
+		records: make([]*crashRecord, 0),
+	}
+}
+
+// open 加载并恢复队列, 校验恢复之后的数据
+func (harness *crashHarness) open(durableOffset int64) {
+	queue := NewMappedFileQueue("/store/commitlog", crashFileSize)
+	queue.Storage = harness.storage
+	if err := queue.Load(); err != nil {
+		harness.t.Fatal(err)
+	}
+	queue.Recover()
+	harness.queue = queue
+	harness.verify(durableOffset)
+}
+
+// verify 恢复之后可以读取的记录必须是写入记录的前缀, 并且包含所有已经刷盘的记录
+func (harness *crashHarness) verify(durableOffset int64) {
+	t := harness.t
+	maxOffset := harness.queue.GetMaxOffset()
+	if maxOffset < durableOffset {
+		t.Fatalf("recovered max offset %d is less than durable offset %d", maxOffset, durableOffset)
+	}
+
+	it := harness.queue.Iterator(harness.queue.GetMinOffset())
+	defer it.Close()
+
+	count := 0
+	for ; it.Next(); count++ {
+		if count >= len(harness.records) {
+			t.Fatalf("unexpected record exposed at %d after the last written record", it.Offset())
+		}
+
+		expected := harness.records[count]
+		if it.Offset() != expected.offset || !bytes.Equal(it.Record().Body, expected.body) {
+			t.Fatalf("record %d mismatch, expect offset %d, got %d", count, expected.offset, it.Offset())
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterate recovered records error: %v", err)
+	}
+
+	if count > 0 && harness.records[count-1].end() > maxOffset {
+		t.Fatalf("record %d ends at %d beyond max offset %d", count-1, harness.records[count-1].end(), maxOffset)
+	}
+
+	//之后的记录全部丢失, 丢失的记录不能是已经刷盘的记录
+	if count < len(harness.records) {
+		if lost := harness.records[count]; lost.end() <= durableOffset {
+			t.Fatalf("durable record %d at %d is lost, durable offset %d", count, lost.offset, durableOffset)
+		}
+	}
+	harness.records = harness.records[:count]
+}
+
+// runWorkload 随机执行逐条写入、批量写入与刷盘
+func (harness *crashHarness) runWorkload(operations int) {
+	for i := 0; i < operations; i++ {
+		switch n := harness.random.Intn(10); {
+		case n < 5:
+			body := harness.randomBody()
+			result, err := harness.queue.AppendRecord(NewRecord(body))
+			if err != nil {
+				harness.t.Fatal(err)
+			}
+			harness.records = append(harness.records, &crashRecord{offset: result.WroteOffset, body: body})
+		case n < 7:
+			bodies := make([][]byte, 1+harness.random.Intn(5))
+			for j := range bodies {
+				bodies[j] = harness.randomBody()
+			}
+			offsets, err := harness.queue.AppendBatch(bodies)
+			if err != nil {
+				harness.t.Fatal(err)
+			}
+			for j, offset := range offsets {
+				harness.records = append(harness.records, &crashRecord{offset: offset, body: bodies[j]})
+			}
+		case n < 9:
+			harness.queue.Flush(harness.random.Intn(2))
+		default:
+			flushAll(harness.queue)
+		}
+	}
+}
+
+// randomBody 长度随机的记录内容
+func (harness *crashHarness) randomBody() []byte {
+	body := make([]byte, 1+harness.random.Intn(300))
+	harness.random.Read(body)
+	return body
+}
+
+// crash 丢弃内存中的队列, 按照 fault 将没有刷盘的数据写回存储, 返回崩溃之前已经刷盘的位置
+func (harness *crashHarness) crash(fault crashFault) int64 {
+	durableOffset := harness.queue.GetFlushedWhere()
+	for _, mappedFile := range harness.queue.getMappedFiles() {
+		data := mappedFile.region.(*heapRegion).data
+		flushPos, writePos := mappedFile.GetFlushPosition(), mappedFile.GetWritePosition()
+
+		switch fault {
+		case faultTornTail:
+			if writePos > flushPos {
+				harness.persist(mappedFile.FileName, data, flushPos, flushPos+harness.random.Int63n(writePos-flushPos+1))
+			}
+		case faultRandomSectors:
+			for sector := flushPos / crashSectorSize * crashSectorSize; sector < writePos; sector += crashSectorSize {
+				if harness.random.Intn(2) == 0 {
+					harness.persist(mappedFile.FileName, data, sector, sector+crashSectorSize)
+				}
+			}
+		case faultZeroSectors:
+			harness.persist(mappedFile.FileName, data, flushPos, writePos)
+			for i := 0; i < 3 && flushPos < mappedFile.FileSize; i++ {
+				sector := flushPos + harness.random.Int63n(mappedFile.FileSize-flushPos)
+				harness.persist(mappedFile.FileName, make([]byte, mappedFile.FileSize), sector, sector+crashSectorSize)
+			}
+		}
+	}
+
+	//不关闭队列, 内存中没有刷盘的数据直接丢失
+	harness.queue = nil
+	return durableOffset
+}
+
+// persist 将 data 中 [start, end) 范围内的数据直接写入存储中的文件
+func (harness *crashHarness) persist(fileName string, data []byte, start int64, end int64) {
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+
+	if start >= end {
+		return
+	}
+
+	file, err := harness.fs.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		harness.t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(data[start:end], start); err != nil {
+		harness.t.Fatal(err)
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	for seed := int64(1); seed <= 500; seed++ {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			harness := newCrashHarness(t, seed)
+			harness.open(0)
+
+			//多次崩溃与恢复, 恢复之后继续写入的数据同样需要满足一致性
+			for cycle := 0; cycle < 4; cycle++ {
+				harness.runWorkload(10 + harness.random.Intn(40))
+				durableOffset := harness.crash(crashFault(harness.random.Intn(int(crashFaultCount))))
+				harness.open(durableOffset)
+			}
+
+			//正常关闭之后所有的记录都不会丢失
+			harness.runWorkload(20)
+			written := len(harness.records)
+			harness.queue.Shutdown()
+			harness.open(0)
+			if len(harness.records) != written {
+				t.Fatalf("expect %d records after clean shutdown, got %d", written, len(harness.records))
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package store
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// diskUsageRatio 获取目录所在磁盘的使用率
+func diskUsageRatio(path string) (float64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	total := float64(stat.Blocks) * float64(stat.Bsize)
+	if total == 0 {
+		return 0, nil
+	}
+
+	free := float64(stat.Bavail) * float64(stat.Bsize)
+	return (total - free) / total, nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package store
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// diskUsageRatio 获取目录所在磁盘的使用率
+func diskUsageRatio(path string) (float64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var freeBytesAvailable, totalBytes, totalFreeBytes uint64
+	if err = windows.GetDiskFreeSpaceEx(pathPtr, &freeBytesAvailable, &totalBytes, &totalFreeBytes); err != nil {
+		return 0, err
+	}
+
+	if totalBytes == 0 {
+		return 0, nil
+	}
+
+	return float64(totalBytes-freeBytesAvailable) / float64(totalBytes), nil
+}
@@ -0,0 +1,382 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrFlushTimeout 同步刷盘等待超时
+	ErrFlushTimeout = errors.New("wait for flush timeout")
+)
+
+// FlushService 刷盘服务
+type FlushService interface {
+	Start()
+
+	Shutdown()
+
+	//Wakeup 唤醒刷盘协程立即刷盘
+	Wakeup()
+}
+
+// FlushRealTimeService 异步刷盘服务, 定时将脏页写回磁盘
+type FlushRealTimeService struct {
+	queue *MappedFileQueue
+
+	config *QueueConfig
+
+	wakeupCh chan struct{}
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+
+	//上一次不考虑脏页数量的刷盘时间
+	lastThoroughFlushTime time.Time
+}
+
+func NewFlushRealTimeService(queue *MappedFileQueue, config *QueueConfig) *FlushRealTimeService {
+	return &FlushRealTimeService{
+		queue:    queue,
+		config:   config,
+		wakeupCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+func (service *FlushRealTimeService) Start() {
+	service.lastThoroughFlushTime = time.Now()
+	service.waitGroup.Add(1)
+	go service.run()
+}
+
+func (service *FlushRealTimeService) Shutdown() {
+	close(service.stopCh)
+	service.waitGroup.Wait()
+}
+
+func (service *FlushRealTimeService) Wakeup() {
+	select {
+	case service.wakeupCh <- struct{}{}:
+	default:
+	}
+}
+
+func (service *FlushRealTimeService) run() {
+	defer service.waitGroup.Done()
+
+	ticker := time.NewTicker(service.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.stopCh:
+			//关闭前将剩余的数据全部刷盘
+			flushAll(service.queue)
+			return
+		case <-ticker.C:
+		case <-service.wakeupCh:
+		}
+
+		flushLeastPages := service.config.FlushLeastPages
+		if time.Since(service.lastThoroughFlushTime) >= service.config.FlushThoroughInterval {
+			service.lastThoroughFlushTime = time.Now()
+			flushLeastPages = 0
+		}
+
+		service.queue.Flush(flushLeastPages)
+	}
+}
+
+// CommitRealTimeService 提交服务, 定时将写入缓冲区中的数据拷贝到映射区域, 提交之后唤醒刷盘服务
+type CommitRealTimeService struct {
+	queue *MappedFileQueue
+
+	config *QueueConfig
+
+	//提交完成后唤醒的刷盘服务
+	flushService FlushService
+
+	wakeupCh chan struct{}
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+
+	//上一次不考虑内存页数量的提交时间
+	lastThoroughCommitTime time.Time
+}
+
+func NewCommitRealTimeService(queue *MappedFileQueue, config *QueueConfig, flushService FlushService) *CommitRealTimeService {
+	return &CommitRealTimeService{
+		queue:        queue,
+		config:       config,
+		flushService: flushService,
+		wakeupCh:     make(chan struct{}, 1),
+		stopCh:       make(chan struct{}),
+	}
+}
+
+func (service *CommitRealTimeService) Start() {
+	service.lastThoroughCommitTime = time.Now()
+	service.waitGroup.Add(1)
+	go service.run()
+}
+
+func (service *CommitRealTimeService) Shutdown() {
+	close(service.stopCh)
+	service.waitGroup.Wait()
+}
+
+func (service *CommitRealTimeService) Wakeup() {
+	select {
+	case service.wakeupCh <- struct{}{}:
+	default:
+	}
+}
+
+func (service *CommitRealTimeService) run() {
+	defer service.waitGroup.Done()
+
+	ticker := time.NewTicker(service.config.CommitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.stopCh:
+			//关闭前将剩余的数据全部提交
+			commitAll(service.queue)
+			service.flushService.Wakeup()
+			return
+		case <-ticker.C:
+		case <-service.wakeupCh:
+		}
+
+		commitLeastPages := service.config.CommitLeastPages
+		if time.Since(service.lastThoroughCommitTime) >= service.config.CommitThoroughInterval {
+			service.lastThoroughCommitTime = time.Now()
+			commitLeastPages = 0
+		}
+
+		if service.queue.Commit(commitLeastPages) {
+			service.flushService.Wakeup()
+		}
+	}
+}
+
+// FlushConsumeQueueService 定时将所有消费队列的脏页刷盘
+type FlushConsumeQueueService struct {
+	store *MessageStore
+
+	config *StoreConfig
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+
+	//上一次不考虑脏页数量的刷盘时间
+	lastThoroughFlushTime time.Time
+}
+
+func NewFlushConsumeQueueService(store *MessageStore, config *StoreConfig) *FlushConsumeQueueService {
+	return &FlushConsumeQueueService{
+		store:  store,
+		config: config,
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (service *FlushConsumeQueueService) Start() {
+	service.lastThoroughFlushTime = time.Now()
+	service.waitGroup.Add(1)
+	go service.run()
+}
+
+func (service *FlushConsumeQueueService) Shutdown() {
+	close(service.stopCh)
+	service.waitGroup.Wait()
+}
+
+func (service *FlushConsumeQueueService) run() {
+	defer service.waitGroup.Done()
+
+	ticker := time.NewTicker(service.config.FlushConsumeQueueInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		flushLeastPages := service.config.FlushConsumeQueueLeastPages
+		if time.Since(service.lastThoroughFlushTime) >= service.config.FlushConsumeQueueThoroughInterval {
+			service.lastThoroughFlushTime = time.Now()
+			flushLeastPages = 0
+		}
+
+		for _, cq := range service.store.getConsumeQueues() {
+			cq.Flush(flushLeastPages)
+		}
+	}
+}
+
+// GroupCommitRequest 同步刷盘请求, 等待数据刷盘到 nextOffset
+type GroupCommitRequest struct {
+	nextOffset int64
+	doneCh     chan bool
+}
+
+func NewGroupCommitRequest(nextOffset int64) *GroupCommitRequest {
+	return &GroupCommitRequest{
+		nextOffset: nextOffset,
+		doneCh:     make(chan bool, 1),
+	}
+}
+
+// Wait 等待刷盘完成, 超时返回 ErrFlushTimeout
+func (req *GroupCommitRequest) Wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case flushOK := <-req.doneCh:
+		if !flushOK {
+			return ErrFlushTimeout
+		}
+		return nil
+	case <-timer.C:
+		return ErrFlushTimeout
+	}
+}
+
+func (req *GroupCommitRequest) wakeupCustomer(flushOK bool) {
+	req.doneCh <- flushOK
+}
+
+// GroupCommitService 同步刷盘服务
+// 写入方提交请求后阻塞等待, 刷盘协程一次性处理积累的所有请求, 多个写入方共享同一次 msync
+type GroupCommitService struct {
+	queue *MappedFileQueue
+
+	lock sync.Mutex
+
+	//写入方提交的请求
+	requestsWrite []*GroupCommitRequest
+
+	//刷盘协程正在处理的请求
+	requestsRead []*GroupCommitRequest
+
+	wakeupCh chan struct{}
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+}
+
+func NewGroupCommitService(queue *MappedFileQueue) *GroupCommitService {
+	return &GroupCommitService{
+		queue:         queue,
+		requestsWrite: make([]*GroupCommitRequest, 0),
+		requestsRead:  make([]*GroupCommitRequest, 0),
+		wakeupCh:      make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+	}
+}
+
+// PutRequest 提交同步刷盘请求并唤醒刷盘协程
+func (service *GroupCommitService) PutRequest(request *GroupCommitRequest) {
+	service.lock.Lock()
+	service.requestsWrite = append(service.requestsWrite, request)
+	service.lock.Unlock()
+	service.Wakeup()
+}
+
+func (service *GroupCommitService) Start() {
+	service.waitGroup.Add(1)
+	go service.run()
+}
+
+func (service *GroupCommitService) Shutdown() {
+	close(service.stopCh)
+	service.waitGroup.Wait()
+}
+
+func (service *GroupCommitService) Wakeup() {
+	select {
+	case service.wakeupCh <- struct{}{}:
+	default:
+	}
+}
+
+func (service *GroupCommitService) swapRequests() {
+	service.lock.Lock()
+	service.requestsWrite, service.requestsRead = service.requestsRead, service.requestsWrite
+	service.lock.Unlock()
+}
+
+func (service *GroupCommitService) run() {
+	defer service.waitGroup.Done()
+
+	timer := time.NewTimer(10 * time.Millisecond)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-service.stopCh:
+			//处理关闭前提交的请求
+			service.swapRequests()
+			service.doCommit()
+			flushAll(service.queue)
+			service.swapRequests()
+			service.doCommit()
+			return
+		case <-service.wakeupCh:
+		case <-timer.C:
+		}
+
+		service.swapRequests()
+		service.doCommit()
+		timer.Reset(10 * time.Millisecond)
+	}
+}
+
+func (service *GroupCommitService) doCommit() {
+	if len(service.requestsRead) == 0 {
+		//没有请求时也需要刷盘, 避免其他写入方的数据长时间停留在内存中
+		service.queue.Flush(0)
+		return
+	}
+
+	for _, request := range service.requestsRead {
+		//批量写入的数据可能跨越多个文件, 每次刷盘只推进一个文件, 刷盘位置不再推进时停止
+		flushOK := service.queue.GetFlushedWhere() >= request.nextOffset
+		for !flushOK && service.queue.Flush(0) {
+			flushOK = service.queue.GetFlushedWhere() >= request.nextOffset
+		}
+
+		request.wakeupCustomer(flushOK)
+	}
+
+	service.requestsRead = service.requestsRead[:0]
+}
+
+// commitAll 将队列中所有写入缓冲区的数据提交到映射区域
+func commitAll(queue *MappedFileQueue) {
+	for queue.Commit(0) {
+	}
+}
+
+// flushAll 将队列中所有的数据提交并刷盘, 每次刷盘都会推进刷盘位置, 没有数据可以刷盘时结束
+func flushAll(queue *MappedFileQueue) {
+	commitAll(queue)
+	for queue.Flush(0) {
+	}
+
+	if queue.GetFlushedWhere() < queue.GetMaxOffset() {
+		Logger.Warnf("MappedFileQueue %s 关闭时未能完成刷盘", queue.FileDir)
+	}
+}
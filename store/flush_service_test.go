@@ -0,0 +1,145 @@
+package store
+
+import (
+	"errors"
+	"github.com/spf13/afero"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingStorage 刷盘失败的存储后端, 用于模拟持续的 I/O 错误
+type failingStorage struct {
+	*HeapStorage
+
+	//为1时所有区域的刷盘都返回错误
+	failing int32
+}
+
+func (storage *failingStorage) OpenRegion(fileName string, size int64, deleteIfExists bool) (Region, error) {
+	region, err := storage.HeapStorage.OpenRegion(fileName, size, deleteIfExists)
+	if err != nil {
+		return nil, err
+	}
+	return &failingRegion{Region: region, storage: storage}, nil
+}
+
+type failingRegion struct {
+	Region
+
+	storage *failingStorage
+}
+
+func (region *failingRegion) Flush(offset int64, length int64) error {
+	if atomic.LoadInt32(&region.storage.failing) == 1 {
+		return errors.New("input/output error")
+	}
+	return region.Region.Flush(offset, length)
+}
+
+func TestSyncFlushGroupCommit(t *testing.T) {
+	queue := newTestQueue(t, 8)
+	queue.Config.FlushMode = SyncFlush
+	queue.Start()
+	defer queue.Shutdown()
+
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			result, err := queue.AppendRecord(NewRecord(testBody(i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if flushed := queue.GetFlushedWhere(); flushed < result.WroteOffset+int64(result.WroteBytes) {
+				t.Errorf("record %d at %d returned before flush, flushed where %d", i, result.WroteOffset, flushed)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+}
+
+func TestSyncFlushBatchAcrossFiles(t *testing.T) {
+	queue := newTestQueue(t, 8)
+	queue.Config.FlushMode = SyncFlush
+	queue.Start()
+	defer queue.Shutdown()
+
+	//一批记录跨越三个文件, 需要刷盘三次
+	records := make([][]byte, 0, 20)
+	for i := 0; i < 20; i++ {
+		records = append(records, testBody(i))
+	}
+
+	offsets, err := queue.AppendBatch(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queue.getMappedFiles()) != 3 {
+		t.Fatalf("expect 3 mapped files, got %d", len(queue.getMappedFiles()))
+	}
+
+	if flushed := queue.GetFlushedWhere(); flushed < offsets[19]+int64(recordHeaderSize+100) {
+		t.Fatalf("batch returned before flush, flushed where %d", flushed)
+	}
+}
+
+func TestFlushError(t *testing.T) {
+	storage := &failingStorage{HeapStorage: NewHeapStorage(afero.NewMemMapFs())}
+	queue := newMemoryQueue(t, storage, 4)
+	for i := 0; i < 6; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt32(&storage.failing, 1)
+	if queue.Flush(0) || queue.GetFlushedWhere() != 0 {
+		t.Fatalf("expect flush to fail without moving flushed where, got %d", queue.GetFlushedWhere())
+	}
+
+	//持续的刷盘失败不能让关闭一直阻塞
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		queue.Shutdown()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown hangs on flush error")
+	}
+
+	if queue.GetFlushedWhere() != 0 {
+		t.Fatalf("expect flushed where 0, got %d", queue.GetFlushedWhere())
+	}
+}
+
+func TestAsyncFlush(t *testing.T) {
+	queue := newTestQueue(t, 8)
+	queue.Config.FlushInterval = 10 * time.Millisecond
+	queue.Config.FlushLeastPages = 0
+	queue.Start()
+
+	for i := 0; i < 10; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for queue.GetFlushedWhere() < queue.GetMaxOffset() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	queue.Shutdown()
+	if flushed := queue.GetFlushedWhere(); flushed != queue.GetMaxOffset() {
+		t.Fatalf("expect flushed where %d, got %d", queue.GetMaxOffset(), flushed)
+	}
+}
@@ -0,0 +1,269 @@
+package store
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	//indexHeaderSize 索引文件头长度: beginTimestamp(8) + endTimestamp(8) + beginPhyOffset(8) + endPhyOffset(8)
+	// + hashSlotCount(4) + indexCount(4)
+	indexHeaderSize = 8 + 8 + 8 + 8 + 4 + 4
+
+	//hashSlotSize 哈希槽长度, 保存槽中最后一个索引条目的编号
+	hashSlotSize = 4
+
+	//indexEntrySize 索引条目长度: keyHash(4) + phyOffset(8) + timeDiff(4) + prevIndex(4)
+	indexEntrySize = 4 + 8 + 4 + 4
+
+	//invalidIndex 索引条目的编号从1开始, 0表示没有索引条目
+	invalidIndex = 0
+)
+
+// IndexFile 哈希索引文件, 由文件头、固定数量的哈希槽与顺序写入的索引条目组成
+// 哈希槽保存最后一个写入该槽的索引条目编号, 索引条目保存同一个槽中前一个条目的编号, 组成一个链表
+type IndexFile struct {
+	mappedFile *MappedFile
+
+	hashSlotNum int
+
+	indexNum int
+
+	//保护文件头与索引区域, 写入方与查询方可能同时访问
+	lock sync.RWMutex
+
+	//第一条索引记录的写入时间, 毫秒
+	beginTimestamp int64
+
+	//最后一条索引记录的写入时间, 毫秒
+	endTimestamp int64
+
+	//第一条索引记录在 commit log 中的偏移量
+	beginPhyOffset int64
+
+	//最后一条索引记录在 commit log 中的偏移量
+	endPhyOffset int64
+
+	//已经使用的哈希槽数量
+	hashSlotCount int32
+
+	//下一个索引条目的编号
+	indexCount int32
+}
+
+// NewIndexFile 打开或创建 storage 中的索引文件, 已存在的文件从文件头中恢复统计信息
+func NewIndexFile(storage Storage, fileName string, hashSlotNum int, indexNum int) (*IndexFile, error) {
+	fileSize := int64(indexHeaderSize + hashSlotNum*hashSlotSize + indexNum*indexEntrySize)
+	mappedFile, err := NewMappedFileWithStorage(storage, fileName, fileSize, false)
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile := &IndexFile{
+		mappedFile:  mappedFile,
+		hashSlotNum: hashSlotNum,
+		indexNum:    indexNum,
+	}
+	indexFile.loadHeader()
+	return indexFile, nil
+}
+
+func (indexFile *IndexFile) loadHeader() {
+	region := indexFile.mappedFile.region.Bytes()
+	indexFile.beginTimestamp = int64(binary.BigEndian.Uint64(region[0:8]))
+	indexFile.endTimestamp = int64(binary.BigEndian.Uint64(region[8:16]))
+	indexFile.beginPhyOffset = int64(binary.BigEndian.Uint64(region[16:24]))
+	indexFile.endPhyOffset = int64(binary.BigEndian.Uint64(region[24:32]))
+	indexFile.hashSlotCount = int32(binary.BigEndian.Uint32(region[32:36]))
+	indexFile.indexCount = int32(binary.BigEndian.Uint32(region[36:40]))
+
+	//新创建的文件中索引条目从1开始编号
+	if indexFile.indexCount <= invalidIndex {
+		indexFile.indexCount = invalidIndex + 1
+	}
+}
+
+func (indexFile *IndexFile) updateHeader() {
+	region := indexFile.mappedFile.region.Bytes()
+	binary.BigEndian.PutUint64(region[0:8], uint64(indexFile.beginTimestamp))
+	binary.BigEndian.PutUint64(region[8:16], uint64(indexFile.endTimestamp))
+	binary.BigEndian.PutUint64(region[16:24], uint64(indexFile.beginPhyOffset))
+	binary.BigEndian.PutUint64(region[24:32], uint64(indexFile.endPhyOffset))
+	binary.BigEndian.PutUint32(region[32:36], uint32(indexFile.hashSlotCount))
+	binary.BigEndian.PutUint32(region[36:40], uint32(indexFile.indexCount))
+}
+
+// PutKey 写入一条索引, 索引条目已经写满时返回false
+func (indexFile *IndexFile) PutKey(key string, phyOffset int64, storeTimestamp int64) bool {
+	indexFile.lock.Lock()
+	defer indexFile.lock.Unlock()
+
+	if indexFile.isWriteFull() {
+		return false
+	}
+
+	region := indexFile.mappedFile.region.Bytes()
+	keyHash := indexKeyHash(key)
+	slotPosition := indexFile.slotPosition(keyHash)
+	slotValue := int32(binary.BigEndian.Uint32(region[slotPosition:]))
+	if slotValue <= invalidIndex || slotValue >= indexFile.indexCount {
+		slotValue = invalidIndex
+	}
+
+	if indexFile.indexCount == invalidIndex+1 {
+		indexFile.beginTimestamp = storeTimestamp
+		indexFile.beginPhyOffset = phyOffset
+	}
+
+	//时间差以秒为单位, 保证4个字节足够保存
+	timeDiff := (storeTimestamp - indexFile.beginTimestamp) / int64(time.Second/time.Millisecond)
+	if timeDiff < 0 {
+		timeDiff = 0
+	}
+
+	entryPosition := indexFile.entryPosition(indexFile.indexCount)
+	binary.BigEndian.PutUint32(region[entryPosition:], uint32(keyHash))
+	binary.BigEndian.PutUint64(region[entryPosition+4:], uint64(phyOffset))
+	binary.BigEndian.PutUint32(region[entryPosition+12:], uint32(timeDiff))
+	binary.BigEndian.PutUint32(region[entryPosition+16:], uint32(slotValue))
+	binary.BigEndian.PutUint32(region[slotPosition:], uint32(indexFile.indexCount))
+
+	if slotValue == invalidIndex {
+		indexFile.hashSlotCount++
+	}
+	indexFile.indexCount++
+	indexFile.endTimestamp = storeTimestamp
+	indexFile.endPhyOffset = phyOffset
+	indexFile.updateHeader()
+	return true
+}
+
+// SelectPhyOffsets 查找 key 在 [beginTime, endTime] 时间范围内的记录偏移量, 最多返回 maxNum 个, 按照写入顺序从新到旧排列
+// 不同的 key 可能具有相同的哈希值, 索引条目中的时间也只精确到秒, 调用方需要根据记录内容与写入时间再次过滤
+func (indexFile *IndexFile) SelectPhyOffsets(key string, maxNum int, beginTime int64, endTime int64) []int64 {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	phyOffsets := make([]int64, 0)
+	region := indexFile.mappedFile.region.Bytes()
+	keyHash := indexKeyHash(key)
+	index := int32(binary.BigEndian.Uint32(region[indexFile.slotPosition(keyHash):]))
+
+	for len(phyOffsets) < maxNum && index > invalidIndex && index < indexFile.indexCount {
+		entryPosition := indexFile.entryPosition(index)
+		entryKeyHash := int32(binary.BigEndian.Uint32(region[entryPosition:]))
+		phyOffset := int64(binary.BigEndian.Uint64(region[entryPosition+4:]))
+		timeDiff := int64(int32(binary.BigEndian.Uint32(region[entryPosition+12:])))
+		prevIndex := int32(binary.BigEndian.Uint32(region[entryPosition+16:]))
+
+		//索引条目中的时间向下取整到秒, 记录的写入时间位于 [timestamp, timestamp+1s) 之间
+		timestamp := indexFile.beginTimestamp + timeDiff*int64(time.Second/time.Millisecond)
+		if entryKeyHash == keyHash && timestamp+int64(time.Second/time.Millisecond) > beginTime && timestamp <= endTime {
+			phyOffsets = append(phyOffsets, phyOffset)
+		}
+
+		//前一个条目的编号一定小于当前条目, 否则说明数据已经损坏
+		if timeDiff < 0 || prevIndex >= index {
+			break
+		}
+		index = prevIndex
+	}
+
+	return phyOffsets
+}
+
+// IsTimeMatched 文件中索引记录的时间范围与 [beginTime, endTime] 是否有交集
+func (indexFile *IndexFile) IsTimeMatched(beginTime int64, endTime int64) bool {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	return indexFile.beginTimestamp <= endTime && indexFile.endTimestamp >= beginTime
+}
+
+// IsWriteFull 索引条目是否已经写满
+func (indexFile *IndexFile) IsWriteFull() bool {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	return indexFile.isWriteFull()
+}
+
+func (indexFile *IndexFile) isWriteFull() bool {
+	return int(indexFile.indexCount) > indexFile.indexNum
+}
+
+// IsEmpty 文件中是否还没有写入索引
+func (indexFile *IndexFile) IsEmpty() bool {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	return indexFile.indexCount == invalidIndex+1
+}
+
+// GetBeginTimestamp 第一条索引记录的写入时间, 毫秒
+func (indexFile *IndexFile) GetBeginTimestamp() int64 {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	return indexFile.beginTimestamp
+}
+
+// GetBeginPhyOffset 第一条索引记录在 commit log 中的偏移量
+func (indexFile *IndexFile) GetBeginPhyOffset() int64 {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	return indexFile.beginPhyOffset
+}
+
+// GetEndPhyOffset 最后一条索引记录在 commit log 中的偏移量
+func (indexFile *IndexFile) GetEndPhyOffset() int64 {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	return indexFile.endPhyOffset
+}
+
+// GetFileName 索引文件的路径
+func (indexFile *IndexFile) GetFileName() string {
+	return indexFile.mappedFile.FileName
+}
+
+// Flush 将索引文件刷盘
+func (indexFile *IndexFile) Flush() {
+	indexFile.lock.RLock()
+	defer indexFile.lock.RUnlock()
+
+	if err := indexFile.mappedFile.region.Flush(0, indexFile.mappedFile.FileSize); err != nil {
+		Logger.Error("Flush index file error: ", err)
+	}
+}
+
+// Close 刷盘并关闭索引文件
+func (indexFile *IndexFile) Close() error {
+	return indexFile.mappedFile.Close()
+}
+
+// Destroy 关闭并删除索引文件
+func (indexFile *IndexFile) Destroy(intervalForcibly time.Duration) error {
+	return indexFile.mappedFile.Destroy(intervalForcibly)
+}
+
+// slotPosition 哈希值对应的哈希槽在文件中的位置
+func (indexFile *IndexFile) slotPosition(keyHash int32) int {
+	return indexHeaderSize + int(keyHash)%indexFile.hashSlotNum*hashSlotSize
+}
+
+// entryPosition 编号为 index 的索引条目在文件中的位置
+func (indexFile *IndexFile) entryPosition(index int32) int {
+	return indexHeaderSize + indexFile.hashSlotNum*hashSlotSize + int(index-1)*indexEntrySize
+}
+
+// indexKeyHash 计算 key 的哈希值, 结果为非负数
+func indexKeyHash(key string) int32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int32(hash.Sum32() & 0x7fffffff)
+}
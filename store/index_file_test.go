@@ -0,0 +1,53 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexFilePutAndSelect(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "00000000000000000000")
+	indexFile, err := NewIndexFile(defaultStorage, fileName, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//哈希槽数量小于 key 的数量, 不同的 key 会共用哈希槽
+	for i := 0; i < 8; i++ {
+		key := "book-" + string(rune('a'+i%3))
+		if !indexFile.PutKey(key, int64(i*100), int64(1000+i*1000)) {
+			t.Fatalf("put key %d failed", i)
+		}
+	}
+
+	if indexFile.PutKey("book-a", 800, 9000) || !indexFile.IsWriteFull() {
+		t.Fatal("expect index file to be full")
+	}
+
+	phyOffsets := indexFile.SelectPhyOffsets("book-a", 10, 0, 10000)
+	if len(phyOffsets) != 3 || phyOffsets[0] != 600 || phyOffsets[1] != 300 || phyOffsets[2] != 0 {
+		t.Fatalf("unexpected phy offsets %v", phyOffsets)
+	}
+
+	//按照时间范围过滤, 时间精度为秒
+	if phyOffsets := indexFile.SelectPhyOffsets("book-a", 10, 2000, 5000); len(phyOffsets) != 1 || phyOffsets[0] != 300 {
+		t.Fatalf("unexpected phy offsets %v", phyOffsets)
+	}
+
+	//重新打开后从文件头恢复
+	if err := indexFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewIndexFile(defaultStorage, fileName, 4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if !reopened.IsWriteFull() || reopened.GetEndPhyOffset() != 700 {
+		t.Fatalf("unexpected reopened index file end phy offset %d", reopened.GetEndPhyOffset())
+	}
+	if phyOffsets := reopened.SelectPhyOffsets("book-b", 1, 0, 10000); len(phyOffsets) != 1 || phyOffsets[0] != 700 {
+		t.Fatalf("unexpected phy offsets %v", phyOffsets)
+	}
+}
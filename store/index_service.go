@@ -0,0 +1,242 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//indexDirName 索引文件所在的目录
+	indexDirName = "index"
+)
+
+// IndexService 维护所有的哈希索引文件, 每个索引文件保存一个时间窗口内写入的记录
+// 当前文件写满或者超过时间窗口后创建新的文件, 查询时按照时间范围从新到旧依次查找
+type IndexService struct {
+	fileDir string
+
+	//索引文件所在的存储后端
+	storage Storage
+
+	config *StoreConfig
+
+	//记录索引刷盘的位置, 为nil时不记录
+	checkpoint *Checkpoint
+
+	//保护 indexFiles
+	lock sync.RWMutex
+
+	//按照创建时间排序的索引文件
+	indexFiles []*IndexFile
+
+	//加载时删除的索引文件中第一条索引记录的偏移量, 需要从该位置开始重新构建, 没有删除文件时为-1
+	rebuildFromOffset int64
+}
+
+func NewIndexService(storage Storage, rootDir string, config *StoreConfig) *IndexService {
+	return &IndexService{
+		fileDir:           filepath.Join(rootDir, indexDirName),
+		storage:           storage,
+		config:            config,
+		indexFiles:        make([]*IndexFile, 0),
+		rebuildFromOffset: -1,
+	}
+}
+
+// Load 加载已经存在的索引文件
+// 最后一条索引超过检查点记录的刷盘位置或者 commit log 写入位置的文件可能不完整, 直接删除之后重新构建
+func (service *IndexService) Load(checkpoint *Checkpoint, maxPhyOffset int64) error {
+	service.checkpoint = checkpoint
+	if err := service.storage.MkdirAll(service.fileDir); err != nil {
+		return err
+	}
+
+	entries, err := service.storage.ReadDir(service.fileDir)
+	if err != nil {
+		return err
+	}
+
+	fileNames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !mappedFileNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		fileNames = append(fileNames, entry.Name())
+	}
+	sort.Strings(fileNames)
+
+	var indexFlushOffset int64 = -1
+	if checkpoint != nil && !checkpoint.IsCreated() {
+		indexFlushOffset = checkpoint.GetIndexFlushOffset()
+	}
+
+	for _, fileName := range fileNames {
+		indexFile, err := NewIndexFile(service.storage, filepath.Join(service.fileDir, fileName), service.config.IndexHashSlotNum, service.config.IndexNum)
+		if err != nil {
+			return err
+		}
+
+		endPhyOffset := indexFile.GetEndPhyOffset()
+		if endPhyOffset >= maxPhyOffset || (indexFlushOffset >= 0 && endPhyOffset > indexFlushOffset) {
+			Logger.Warnf("索引文件 %s 可能不完整, 删除之后重新构建", indexFile.GetFileName())
+			if !indexFile.IsEmpty() && (service.rebuildFromOffset < 0 || indexFile.GetBeginPhyOffset() < service.rebuildFromOffset) {
+				service.rebuildFromOffset = indexFile.GetBeginPhyOffset()
+			}
+			if err := indexFile.Destroy(0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		service.indexFiles = append(service.indexFiles, indexFile)
+		Logger.Infof("加载索引文件: %s", indexFile.GetFileName())
+	}
+
+	return nil
+}
+
+// GetReputFromOffset 需要从 commit log 中重新分发构建索引的起始位置, 没有需要重新构建的索引时返回-1
+func (service *IndexService) GetReputFromOffset() int64 {
+	reputFromOffset := service.rebuildFromOffset
+
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	for i := len(service.indexFiles) - 1; i >= 0; i-- {
+		if indexFile := service.indexFiles[i]; !indexFile.IsEmpty() {
+			if reputFromOffset < 0 || indexFile.GetEndPhyOffset() < reputFromOffset {
+				reputFromOffset = indexFile.GetEndPhyOffset()
+			}
+			break
+		}
+	}
+
+	return reputFromOffset
+}
+
+// Dispatch 为记录的所有业务主键写入索引
+func (service *IndexService) Dispatch(request *DispatchRequest) {
+	if len(request.Keys) == 0 {
+		return
+	}
+
+	//重新分发时已经写入过索引的记录直接跳过
+	lastFile := service.getLastFile()
+	if lastFile != nil && !lastFile.IsEmpty() && request.CommitLogOffset <= lastFile.GetEndPhyOffset() {
+		return
+	}
+
+	for _, key := range request.Keys {
+		if !service.putKey(key, request.CommitLogOffset, request.StoreTimestamp) {
+			Logger.Errorf("写入索引失败, key: %s, offset: %d", key, request.CommitLogOffset)
+			return
+		}
+	}
+}
+
+// putKey 在最后一个索引文件中写入索引, 文件写满时创建新的文件重试一次
+func (service *IndexService) putKey(key string, phyOffset int64, storeTimestamp int64) bool {
+	for i := 0; i < 2; i++ {
+		indexFile, err := service.getAndCreateLastIndexFile(storeTimestamp)
+		if err != nil {
+			Logger.Error("Create index file error: ", err)
+			return false
+		}
+
+		if indexFile.PutKey(key, phyOffset, storeTimestamp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getAndCreateLastIndexFile 获取最后一个索引文件, 文件写满或者超过时间窗口时创建新的文件并将之前的文件刷盘
+func (service *IndexService) getAndCreateLastIndexFile(storeTimestamp int64) (*IndexFile, error) {
+	lastFile := service.getLastFile()
+	if lastFile != nil && !lastFile.IsWriteFull() && (lastFile.IsEmpty() || storeTimestamp-lastFile.GetBeginTimestamp() < service.config.IndexFileTimeWindow.Milliseconds()) {
+		return lastFile, nil
+	}
+
+	//文件名为创建时间, 保证与之前的文件不重复且递增
+	fileTimestamp := time.Now().UnixMilli()
+	if lastFile != nil {
+		if lastTimestamp := lastFile.mappedFile.fileFromOffset; fileTimestamp <= lastTimestamp {
+			fileTimestamp = lastTimestamp + 1
+		}
+	}
+
+	fileName := filepath.Join(service.fileDir, fmt.Sprintf("%020d", fileTimestamp))
+	indexFile, err := NewIndexFile(service.storage, fileName, service.config.IndexHashSlotNum, service.config.IndexNum)
+	if err != nil {
+		return nil, err
+	}
+
+	service.lock.Lock()
+	service.indexFiles = append(service.indexFiles, indexFile)
+	service.lock.Unlock()
+	Logger.Infof("创建索引文件: %s", fileName)
+
+	if lastFile != nil {
+		service.flushIndexFile(lastFile)
+	}
+	return indexFile, nil
+}
+
+// flushIndexFile 将索引文件刷盘并记录刷盘位置
+func (service *IndexService) flushIndexFile(indexFile *IndexFile) {
+	indexFile.Flush()
+	if service.checkpoint != nil {
+		service.checkpoint.SetIndexFlushOffset(indexFile.GetEndPhyOffset())
+		service.checkpoint.Flush()
+	}
+}
+
+// QueryOffsets 查找 key 在 [beginTime, endTime] 时间范围内的记录偏移量, 最多返回 maxNum 个, 按照写入顺序从新到旧排列
+func (service *IndexService) QueryOffsets(key string, maxNum int, beginTime int64, endTime int64) []int64 {
+	service.lock.RLock()
+	indexFiles := service.indexFiles
+	service.lock.RUnlock()
+
+	phyOffsets := make([]int64, 0)
+	for i := len(indexFiles) - 1; i >= 0 && len(phyOffsets) < maxNum; i-- {
+		indexFile := indexFiles[i]
+		if !indexFile.IsTimeMatched(beginTime, endTime) {
+			continue
+		}
+
+		phyOffsets = append(phyOffsets, indexFile.SelectPhyOffsets(key, maxNum-len(phyOffsets), beginTime, endTime)...)
+	}
+
+	return phyOffsets
+}
+
+// Shutdown 将最后一个索引文件刷盘并关闭所有索引文件
+func (service *IndexService) Shutdown() {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+
+	if fileCount := len(service.indexFiles); fileCount > 0 {
+		service.flushIndexFile(service.indexFiles[fileCount-1])
+	}
+
+	for _, indexFile := range service.indexFiles {
+		if err := indexFile.Close(); err != nil {
+			Logger.Error("Close index file error: ", err)
+		}
+	}
+	service.indexFiles = make([]*IndexFile, 0)
+}
+
+// getLastFile 获取最新的索引文件
+func (service *IndexService) getLastFile() *IndexFile {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+
+	if fileCount := len(service.indexFiles); fileCount > 0 {
+		return service.indexFiles[fileCount-1]
+	}
+	return nil
+}
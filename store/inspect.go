@@ -0,0 +1,410 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/edsrzf/mmap-go"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+var (
+	//ErrUnalignedOffset 偏移量没有对齐到记录的起始位置
+	ErrUnalignedOffset = errors.New("offset is not at a record boundary")
+
+	//ErrNoSegmentFile 目录下没有文件
+	ErrNoSegmentFile = errors.New("no segment file found")
+)
+
+// SegmentInfo 文件的概要信息, 用于排查问题
+type SegmentInfo struct {
+	FileName string
+
+	//文件的起始偏移量
+	FileFromOffset int64
+
+	FileSize int64
+
+	//最后一条完整记录的结束位置, 文件已经写满时为文件大小
+	ValidLength int64
+
+	RecordCount int
+
+	//第一条与最后一条记录的写入时间, 文件中没有记录时为0
+	FirstTimestamp int64
+
+	LastTimestamp int64
+
+	//校验失败的原因, 文件完整时为nil
+	Err error
+}
+
+// VerifyReport 校验所有文件的结果
+type VerifyReport struct {
+	FileCount int
+
+	RecordCount int
+
+	//最后一条完整记录的结束位置
+	MaxOffset int64
+
+	//第一条损坏记录的全局偏移量, 没有损坏时为-1
+	CorruptOffset int64
+
+	//损坏的原因
+	CorruptErr error
+}
+
+// ListSegments 读取目录下的所有文件, 逐条校验记录并统计每个文件的信息
+// 只读取文件, 不会执行恢复与截断, 可以用于正在运行的存储之外的数据
+func ListSegments(fileDir string) ([]*SegmentInfo, error) {
+	mappedFiles, err := openSegments(fileDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSegments(mappedFiles)
+
+	segments := make([]*SegmentInfo, 0, len(mappedFiles))
+	for _, mappedFile := range mappedFiles {
+		segment := &SegmentInfo{
+			FileName:       mappedFile.FileName,
+			FileFromOffset: mappedFile.fileFromOffset,
+			FileSize:       mappedFile.FileSize,
+		}
+
+		end, _, err := walkSegment(mappedFile, 0, func(offset int64, record *Record) bool {
+			if segment.RecordCount == 0 {
+				segment.FirstTimestamp = record.StoreTimestamp
+			}
+			segment.LastTimestamp = record.StoreTimestamp
+			segment.RecordCount++
+			return true
+		})
+		segment.ValidLength = end
+		segment.Err = err
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
+// DumpRecords 从 fromOffset 开始顺序读取记录, fn 返回false时停止, 记录内容只在 fn 中有效
+// fromOffset 需要对齐到记录的起始位置, 读到损坏的记录时返回错误
+func DumpRecords(fileDir string, fromOffset int64, fn func(offset int64, record *Record) bool) error {
+	mappedFiles, err := openSegments(fileDir, true)
+	if err != nil {
+		return err
+	}
+	defer closeSegments(mappedFiles)
+
+	index := findSegmentIndex(mappedFiles, fromOffset)
+	if index < 0 {
+		return fmt.Errorf("offset %d is out of range", fromOffset)
+	}
+
+	position := fromOffset - mappedFiles[index].fileFromOffset
+	for ; index < len(mappedFiles); index++ {
+		stopped := false
+		end, full, err := walkSegment(mappedFiles[index], position, func(offset int64, record *Record) bool {
+			stopped = !fn(offset, record)
+			return !stopped
+		})
+
+		if err != nil {
+			return fmt.Errorf("read record at %d: %w", mappedFiles[index].fileFromOffset+end, err)
+		}
+
+		if stopped || !full {
+			return nil
+		}
+		position = 0
+	}
+
+	return nil
+}
+
+// VerifySegments 从第一个文件开始校验所有记录的 CRC, 找到第一条损坏的记录
+// 除最后一个文件外, 文件在写满之前结束也视为损坏
+func VerifySegments(fileDir string) (*VerifyReport, error) {
+	mappedFiles, err := openSegments(fileDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSegments(mappedFiles)
+
+	report := &VerifyReport{
+		FileCount:     len(mappedFiles),
+		MaxOffset:     mappedFiles[0].fileFromOffset,
+		CorruptOffset: -1,
+	}
+
+	for i, mappedFile := range mappedFiles {
+		//文件之间的偏移量必须是连续的
+		if i > 0 && mappedFiles[i-1].fileFromOffset+mappedFiles[i-1].FileSize != mappedFile.fileFromOffset {
+			report.CorruptOffset = mappedFiles[i-1].fileFromOffset + mappedFiles[i-1].FileSize
+			report.CorruptErr = fmt.Errorf("mapped file %s is not continuous with previous file", mappedFile.FileName)
+			return report, nil
+		}
+
+		end, full, err := walkSegment(mappedFile, 0, func(offset int64, record *Record) bool {
+			report.RecordCount++
+			return true
+		})
+		report.MaxOffset = mappedFile.fileFromOffset + end
+
+		if err == nil && !full && i < len(mappedFiles)-1 {
+			err = ErrNoMoreRecord
+		}
+
+		if err != nil {
+			report.CorruptOffset = mappedFile.fileFromOffset + end
+			report.CorruptErr = err
+			return report, nil
+		}
+	}
+
+	return report, nil
+}
+
+// TruncateSegments 删除 offset 之后的所有数据, offset 必须对齐到记录的起始位置
+// offset 所在文件之后的数据清零, 之后的文件直接删除, 检查点中超过 offset 的位置重置为 offset
+// 截断时不能有其他进程正在使用这些文件
+func TruncateSegments(fileDir string, offset int64) error {
+	mappedFiles, err := openSegments(fileDir, false)
+	if err != nil {
+		return err
+	}
+
+	index := findSegmentIndex(mappedFiles, offset)
+	if index < 0 {
+		closeSegments(mappedFiles)
+		return fmt.Errorf("offset %d is out of range", offset)
+	}
+
+	//从文件头开始读取, 确认 offset 是一条记录的起始位置
+	truncateFile := mappedFiles[index]
+	position := offset - truncateFile.fileFromOffset
+	end, full, err := walkSegment(truncateFile, 0, func(recordOffset int64, record *Record) bool {
+		return recordOffset-truncateFile.fileFromOffset < position
+	})
+
+	//文件结束标记的位置也可以截断
+	aligned := end == position
+	if !aligned && full {
+		_, markerErr := truncateFile.ReadRecord(position)
+		aligned = markerErr == ErrEndOfFile
+	}
+	closeSegments(mappedFiles)
+
+	if !aligned && err != nil && end < position {
+		return fmt.Errorf("read record at %d: %w", truncateFile.fileFromOffset+end, err)
+	}
+
+	if !aligned {
+		return fmt.Errorf("%w: %d", ErrUnalignedOffset, offset)
+	}
+
+	if err := zeroFileFrom(truncateFile.FileName, position, truncateFile.FileSize); err != nil {
+		return err
+	}
+
+	for _, mappedFile := range mappedFiles[index+1:] {
+		if err := os.Remove(mappedFile.FileName); err != nil {
+			return err
+		}
+		Logger.Infof("截断时删除文件: %s", mappedFile.FileName)
+	}
+
+	return truncateCheckpoint(filepath.Join(fileDir, checkpointFileName), offset)
+}
+
+// walkSegment 从 position 开始顺序读取文件中的记录, fn 返回false时停止
+// 返回停止的位置与是否读到了文件结束标记, 读到没有写入过数据的位置时正常结束
+func walkSegment(mappedFile *MappedFile, position int64, fn func(offset int64, record *Record) bool) (int64, bool, error) {
+	for position < mappedFile.FileSize {
+		record, err := mappedFile.ReadRecord(position)
+		if err == ErrEndOfFile {
+			return mappedFile.FileSize, true, nil
+		}
+
+		if err == ErrNoMoreRecord {
+			return position, false, nil
+		}
+
+		if err != nil {
+			return position, false, err
+		}
+
+		proceed := fn(mappedFile.fileFromOffset+position, record)
+		size := int64(record.TotalSize)
+		record.Release()
+		if !proceed {
+			return position, false, nil
+		}
+		position += size
+	}
+
+	return position, position == mappedFile.FileSize, nil
+}
+
+// openSegments 按照偏移量顺序映射目录下的所有文件, 文件大小以实际大小为准
+// readOnly 为true时只读映射, 关闭时不会提交与刷盘, 用于检查正在被其他进程使用的文件
+func openSegments(fileDir string, readOnly bool) ([]*MappedFile, error) {
+	entries, err := os.ReadDir(fileDir)
+	if err != nil {
+		return nil, err
+	}
+
+	fileNames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !mappedFileNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		fileNames = append(fileNames, entry.Name())
+	}
+	sort.Strings(fileNames)
+
+	if len(fileNames) == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoSegmentFile, fileDir)
+	}
+
+	mappedFiles := make([]*MappedFile, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		fileName = filepath.Join(fileDir, fileName)
+		stat, err := os.Stat(fileName)
+		if err == nil && stat.Size() == 0 {
+			err = fmt.Errorf("mapped file %s is empty", fileName)
+		}
+
+		var mappedFile *MappedFile
+		if err == nil && readOnly {
+			mappedFile, err = openReadOnlySegment(fileName, stat.Size())
+		} else if err == nil {
+			mappedFile, err = NewMappedFile(fileName, stat.Size(), false)
+		}
+
+		if err != nil {
+			closeSegments(mappedFiles)
+			return nil, err
+		}
+
+		mappedFile.SetWritePosition(mappedFile.FileSize)
+		mappedFiles = append(mappedFiles, mappedFile)
+	}
+
+	return mappedFiles, nil
+}
+
+// openReadOnlySegment 只读映射文件, 对映射区域的任何写入都会触发异常
+func openReadOnlySegment(fileName string, size int64) (*MappedFile, error) {
+	fileFromOffset, err := strconv.ParseInt(filepath.Base(fileName), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapped file name %s: %w", fileName, err)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	mappedRegion, err := mmap.MapRegion(file, int(size), mmap.RDONLY, 0, 0)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	mappedFile := &MappedFile{
+		FileName:       fileName,
+		FileSize:       size,
+		storage:        defaultStorage,
+		region:         &readOnlyRegion{mmapRegion: &mmapRegion{file: file, region: mappedRegion}},
+		fileFromOffset: fileFromOffset,
+	}
+	mappedFile.ReferenceResource = newReferenceResource(mappedFile.unmap)
+	return mappedFile, nil
+}
+
+// readOnlyRegion 只读的内存映射, 没有需要刷盘的数据
+type readOnlyRegion struct {
+	*mmapRegion
+}
+
+func (region *readOnlyRegion) Flush(offset int64, length int64) error {
+	return nil
+}
+
+func closeSegments(mappedFiles []*MappedFile) {
+	for _, mappedFile := range mappedFiles {
+		if err := mappedFile.Close(); err != nil {
+			Logger.Error("Close MappedFile error: ", err)
+		}
+	}
+}
+
+// findSegmentIndex 查找包含 offset 的文件, 不存在时返回-1
+// offset 位于最后一个文件的末尾时返回最后一个文件, 文件写满时该位置就是最大偏移量
+func findSegmentIndex(mappedFiles []*MappedFile, offset int64) int {
+	for i, mappedFile := range mappedFiles {
+		if mappedFile.fileFromOffset <= offset && offset < mappedFile.fileFromOffset+mappedFile.FileSize {
+			return i
+		}
+	}
+
+	last := len(mappedFiles) - 1
+	if offset == mappedFiles[last].fileFromOffset+mappedFiles[last].FileSize {
+		return last
+	}
+	return -1
+}
+
+// zeroFileFrom 将文件 position 之后的内容清零并刷盘
+func zeroFileFrom(fileName string, position int64, fileSize int64) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, 64*1024)
+	for position < fileSize {
+		n := int64(len(zeros))
+		if fileSize-position < n {
+			n = fileSize - position
+		}
+
+		if _, err := file.WriteAt(zeros[:n], position); err != nil {
+			_ = file.Close()
+			return err
+		}
+		position += n
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// truncateCheckpoint 将检查点中超过 offset 的刷盘位置重置为 offset, 检查点不存在时忽略
+func truncateCheckpoint(fileName string, offset int64) error {
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	checkpoint, err := NewCheckpoint(defaultStorage, fileName)
+	if err != nil {
+		return err
+	}
+
+	if checkpoint.GetFlushedOffset() > offset {
+		checkpoint.SetFlushedOffset(offset)
+	}
+
+	if checkpoint.GetIndexFlushOffset() > offset {
+		checkpoint.SetIndexFlushOffset(offset)
+	}
+	checkpoint.Flush()
+	return checkpoint.Close()
+}
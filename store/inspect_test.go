@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+// newTestSegments 写入 count 条记录并关闭队列, 每个文件恰好容纳4条记录
+func newTestSegments(t *testing.T, count int) *MappedFileQueue {
+	queue := newTestQueue(t, 4)
+	if err := queue.Load(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Recover()
+
+	for i := 0; i < count; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.Shutdown()
+	return queue
+}
+
+func TestListAndDumpSegments(t *testing.T) {
+	queue := newTestSegments(t, 10)
+
+	segments, err := ListSegments(queue.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 3 {
+		t.Fatalf("expect 3 segments, got %d", len(segments))
+	}
+
+	last := segments[2]
+	if last.FileFromOffset != 2*queue.FileSize || last.RecordCount != 2 || last.ValidLength != 2*int64(recordHeaderSize+100) || last.Err != nil {
+		t.Fatalf("unexpected last segment %+v", last)
+	}
+
+	if segments[0].FirstTimestamp == 0 || segments[0].LastTimestamp < segments[0].FirstTimestamp {
+		t.Fatalf("unexpected timestamps %+v", segments[0])
+	}
+
+	//从第二个文件的第二条记录开始读取, 跨越文件边界
+	recordSize := int64(recordHeaderSize + 100)
+	count := 0
+	err = DumpRecords(queue.FileDir, queue.FileSize+recordSize, func(offset int64, record *Record) bool {
+		i := 5 + count
+		if !bytes.Equal(record.Body, testBody(i)) || offset != int64(i/4)*queue.FileSize+int64(i%4)*recordSize {
+			t.Fatalf("unexpected record %d at %d", count, offset)
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 5 {
+		t.Fatalf("expect 5 records, got %d", count)
+	}
+}
+
+func TestVerifyAndTruncateSegments(t *testing.T) {
+	queue := newTestSegments(t, 10)
+	recordSize := int64(recordHeaderSize + 100)
+
+	report, err := VerifySegments(queue.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.CorruptOffset != -1 || report.RecordCount != 10 || report.MaxOffset != 2*queue.FileSize+2*recordSize {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	//破坏第二个文件中第三条记录的内容
+	corruptOffset := queue.FileSize + 2*recordSize
+	file, err := os.OpenFile(queue.mappedFileName(queue.FileSize), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{0xff}, 2*recordSize+int64(recordHeaderSize)+1); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	report, err = VerifySegments(queue.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.CorruptOffset != corruptOffset || !errors.Is(report.CorruptErr, ErrCRCMismatch) || report.RecordCount != 6 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	if err := TruncateSegments(queue.FileDir, corruptOffset-1); !errors.Is(err, ErrUnalignedOffset) {
+		t.Fatalf("expect unaligned offset, got %v", err)
+	}
+
+	if err := TruncateSegments(queue.FileDir, corruptOffset); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = VerifySegments(queue.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.CorruptOffset != -1 || report.FileCount != 2 || report.MaxOffset != corruptOffset {
+		t.Fatalf("unexpected report after truncate %+v", report)
+	}
+
+	//截断之后重新加载, 从截断位置继续写入
+	reopened := NewMappedFileQueue(queue.FileDir, queue.FileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+	defer reopened.Shutdown()
+
+	if reopened.GetMaxOffset() != corruptOffset {
+		t.Fatalf("expect max offset %d, got %d", corruptOffset, reopened.GetMaxOffset())
+	}
+}
+
+func TestInspectReadOnlySegments(t *testing.T) {
+	queue := newTestSegments(t, 10)
+
+	//检查时只读映射, 没有写权限的文件也可以读取
+	for _, mappedFile := range queue.getMappedFiles() {
+		if err := os.Chmod(mappedFile.FileName, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mappedFiles, err := openSegments(queue.FileDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mappedFile := range mappedFiles {
+		if _, ok := mappedFile.region.(*readOnlyRegion); !ok {
+			t.Fatalf("expect read only region for %s", mappedFile.FileName)
+		}
+	}
+	closeSegments(mappedFiles)
+
+	if _, err := ListSegments(queue.FileDir); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	err = DumpRecords(queue.FileDir, 0, func(offset int64, record *Record) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 10 {
+		t.Fatalf("expect 10 records, got %d, %v", count, err)
+	}
+
+	report, err := VerifySegments(queue.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.CorruptOffset != -1 || report.RecordCount != 10 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestTruncateSegmentsAtEnd(t *testing.T) {
+	//最后一个文件恰好写满, 最大偏移量位于文件末尾, 截断到该位置不会删除数据
+	queue := newTestSegments(t, 8)
+	maxOffset := 2 * queue.FileSize
+	if err := TruncateSegments(queue.FileDir, maxOffset); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifySegments(queue.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.CorruptOffset != -1 || report.FileCount != 2 || report.RecordCount != 8 || report.MaxOffset != maxOffset {
+		t.Fatalf("unexpected report after truncate %+v", report)
+	}
+
+	count := 0
+	err = DumpRecords(queue.FileDir, maxOffset, func(offset int64, record *Record) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 0 {
+		t.Fatalf("expect no records after max offset, got %d, %v", count, err)
+	}
+
+	//最后一个文件没有写满时文件末尾不是记录的边界
+	queue = newTestSegments(t, 10)
+	if err := TruncateSegments(queue.FileDir, 3*queue.FileSize); !errors.Is(err, ErrUnalignedOffset) {
+		t.Fatalf("expect unaligned offset, got %v", err)
+	}
+
+	if err := TruncateSegments(queue.FileDir, 3*queue.FileSize+1); err == nil || errors.Is(err, ErrUnalignedOffset) {
+		t.Fatalf("expect offset out of range, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"errors"
+)
+
+// Iterator 从指定的全局偏移量开始顺序读取记录, 读到文件末尾时自动切换到下一个文件
+type Iterator struct {
+	queue *MappedFileQueue
+
+	//当前记录的全局偏移量
+	offset int64
+
+	//下一条记录的全局偏移量
+	nextOffset int64
+
+	record *Record
+
+	err error
+}
+
+// Next 读取下一条记录, 没有更多记录或者出现错误时返回false
+// 没有更多记录时可以在新数据写入之后再次调用 Next 继续读取, 迭代结束后需要调用 Close
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	for {
+		mappedFile, err := it.queue.FindMappedFileByOffset(it.nextOffset)
+		if err != nil {
+			//超出写入位置时等待新数据写入, 其余情况说明数据已经被删除
+			if !errors.Is(err, ErrOffsetBeyondMax) {
+				it.err = err
+			}
+			return false
+		}
+
+		position := it.nextOffset - mappedFile.fileFromOffset
+		record, err := mappedFile.ReadRecord(position)
+		if err == ErrEndOfFile || err == ErrNoMoreRecord {
+			//当前文件已经读完, 如果后面还有文件则跳到下一个文件的起始位置
+			//使用写入缓冲区时文件可能还有数据没有提交, 需要等到全部可读之后才能跳过
+			if err == ErrEndOfFile || (mappedFile != it.queue.getLastFile() && mappedFile.GetReadPosition() == it.queue.FileSize) {
+				it.nextOffset = mappedFile.fileFromOffset + it.queue.FileSize
+				continue
+			}
+			return false
+		}
+
+		//文件已经被关闭, 说明数据已经被删除
+		if errors.Is(err, ErrMappedFileUnavailable) {
+			it.err = it.queue.newOffsetError(it.nextOffset, ErrOffsetDeleted)
+			return false
+		}
+
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.releaseRecord()
+		it.record = record
+		it.offset = it.nextOffset
+		it.nextOffset += int64(record.TotalSize)
+		return true
+	}
+}
+
+// Close 释放当前记录对文件的引用
+func (it *Iterator) Close() {
+	it.releaseRecord()
+}
+
+func (it *Iterator) releaseRecord() {
+	if it.record != nil {
+		it.record.Release()
+		it.record = nil
+	}
+}
+
+// Record 当前记录, 记录内容在下一次调用 Next 或者 Close 之前有效
+func (it *Iterator) Record() *Record {
+	return it.record
+}
+
+// Offset 当前记录的全局偏移量
+func (it *Iterator) Offset() int64 {
+	return it.offset
+}
+
+// NextOffset 下一条记录的全局偏移量, 可用于保存读取进度
+func (it *Iterator) NextOffset() int64 {
+	return it.nextOffset
+}
+
+// Err 迭代过程中出现的错误
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestQueue 创建每个文件恰好容纳 recordsPerFile 条记录的队列
+func newTestQueue(t *testing.T, recordsPerFile int) *MappedFileQueue {
+	return NewMappedFileQueue(t.TempDir(), int64(recordsPerFile*(recordHeaderSize+100)))
+}
+
+// lastMappedFile 获取队列的最后一个文件, 没有文件或者已经写满时创建新的文件
+func lastMappedFile(t *testing.T, queue *MappedFileQueue) *MappedFile {
+	mappedFile, err := queue.GetLastMappedFile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mappedFile
+}
+
+func testBody(i int) []byte {
+	return []byte(fmt.Sprintf("%-100d", i))
+}
+
+func TestIteratorAcrossMappedFiles(t *testing.T) {
+	queue := newTestQueue(t, 4)
+	for i := 0; i < 10; i++ {
+		if _, err := lastMappedFile(t, queue).AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fileCount := len(queue.mappedFiles); fileCount != 3 {
+		t.Fatalf("expect 3 mapped files, got %d", fileCount)
+	}
+
+	it := queue.Iterator(0)
+	defer it.Close()
+	count := 0
+	for it.Next() {
+		if !bytes.Equal(it.Record().Body, testBody(count)) {
+			t.Fatalf("unexpected record body %s at %d", it.Record().Body, it.Offset())
+		}
+		count++
+	}
+
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if count != 10 {
+		t.Fatalf("expect 10 records, got %d", count)
+	}
+
+	//写入新数据后迭代器可以继续读取
+	if _, err := lastMappedFile(t, queue).AppendRecord(NewRecord(testBody(10))); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() || !bytes.Equal(it.Record().Body, testBody(10)) {
+		t.Fatal("expect iterator to read the new record")
+	}
+}
+
+func TestReadAtAcrossMappedFiles(t *testing.T) {
+	queue := newTestQueue(t, 1)
+	for i := 0; i < 2; i++ {
+		if _, err := lastMappedFile(t, queue).AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//读取第一条记录的末尾与第二条记录的开头
+	data, err := queue.ReadAt(queue.FileSize-10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := append(testBody(0)[90:], NewRecord(testBody(1)).Encode()[:10]...)
+	if !bytes.Equal(data, expect) {
+		t.Fatalf("unexpected data %v", data)
+	}
+
+	if _, err := queue.ReadAt(queue.GetMaxOffset()-1, 2); !errors.Is(err, ErrOffsetBeyondMax) {
+		t.Fatalf("expect offset out of range, got %v", err)
+	}
+}
+
+func TestOffsetForTimestamp(t *testing.T) {
+	queue := newTestQueue(t, 4)
+	offsets := make([]int64, 0, 10)
+	for i := 0; i < 10; i++ {
+		record := NewRecord(testBody(i))
+		record.StoreTimestamp = int64(1000 + i*10)
+		result, err := lastMappedFile(t, queue).AppendRecord(record)
+		if err == ErrInsufficientSpace {
+			result, err = lastMappedFile(t, queue).AppendRecord(record)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, result.WroteOffset)
+	}
+
+	cases := []struct {
+		timestamp int64
+		offset    int64
+	}{
+		{0, offsets[0]},
+		{1000, offsets[0]},
+		{1035, offsets[4]},
+		{1040, offsets[4]},
+		{1075, offsets[8]},
+		{1090, offsets[9]},
+		{2000, queue.GetMaxOffset()},
+	}
+	for _, c := range cases {
+		offset, err := queue.OffsetForTimestamp(c.timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != c.offset {
+			t.Fatalf("expect offset %d for timestamp %d, got %d", c.offset, c.timestamp, offset)
+		}
+	}
+
+	it, err := queue.IteratorFromTimestamp(1055)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	if !it.Next() || !bytes.Equal(it.Record().Body, testBody(6)) {
+		t.Fatalf("expect record 6, got %v", it.Err())
+	}
+}
+
+func TestRecoverLastTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewMappedFileQueue(dir, int64(4*(recordHeaderSize+100)))
+	for i := 0; i < 10; i++ {
+		record := NewRecord(testBody(i))
+		record.StoreTimestamp = int64(1000 + i*10)
+		if _, err := queue.AppendRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.Shutdown()
+
+	reopened := NewMappedFileQueue(dir, queue.FileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+	defer reopened.Shutdown()
+
+	//恢复时校验过的文件缓存了最后一条记录的写入时间
+	for i, mappedFile := range reopened.getMappedFiles() {
+		expect := int64(1000 + (i*4+3)*10)
+		if i == 2 {
+			expect = 1090
+		}
+
+		if lastTimestamp := atomic.LoadInt64(&mappedFile.lastStoreTimestamp); lastTimestamp != expect {
+			t.Fatalf("expect last timestamp %d of %s, got %d", expect, mappedFile.FileName, lastTimestamp)
+		}
+	}
+
+	offset, err := reopened.OffsetForTimestamp(1045)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != queue.FileSize+int64(recordHeaderSize+100) {
+		t.Fatalf("unexpected offset %d for timestamp 1045", offset)
+	}
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"time"
+)
+
+// Logger store 使用的日志, 默认输出到标准错误, 不依赖 statics 的配置文件, 保证命令行工具的标准输出只包含命令结果
+// 使用方可以在启动之前替换为自己的 logger
+var Logger = newLogger(zap.DebugLevel).Sugar()
+
+// newLogger 创建输出到标准错误的非结构化日志
+func newLogger(logLevel zapcore.Level) *zap.Logger {
+	config := zapcore.EncoderConfig{
+		MessageKey:   "msg",
+		LevelKey:     "level",
+		TimeKey:      "ts",
+		CallerKey:    "file",
+		EncodeLevel:  zapcore.CapitalLevelEncoder,
+		EncodeCaller: zapcore.ShortCallerEncoder,
+		EncodeTime: func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+			enc.AppendString(t.Format("2006-01-02 15:04:05"))
+		},
+		EncodeDuration: func(d time.Duration, enc zapcore.PrimitiveArrayEncoder) {
+			enc.AppendInt64(d.Milliseconds())
+		},
+	}
+
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(config), zapcore.AddSync(os.Stderr), logLevel)
+	return zap.New(core, zap.AddCaller())
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package store
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// madviseWillNeed 通知内核即将访问映射区域, 提前读取到页缓存
+func madviseWillNeed(region []byte) error {
+	return unix.Madvise(region, unix.MADV_WILLNEED)
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package store
+
+// madviseWillNeed Windows不支持madvise
+func madviseWillNeed(region []byte) error {
+	return nil
+}
@@ -0,0 +1,491 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	//commitLogDirName commit log 文件所在的目录
+	commitLogDirName = "commitlog"
+
+	//consumeQueueDirName 消费队列文件所在的目录
+	consumeQueueDirName = "consumequeue"
+
+	//configDirName 消费进度等配置文件所在的目录
+	configDirName = "config"
+)
+
+var (
+	//topicNamePattern topic 会作为目录名, 只允许使用字母、数字、下划线与中划线
+	topicNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	//ErrIllegalTopic topic 为空或者包含不允许的字符
+	ErrIllegalTopic = errors.New("illegal topic name")
+
+	//ErrIllegalQueueId 队列编号不能为负数
+	ErrIllegalQueueId = errors.New("illegal queue id")
+
+	//ErrConsumeQueueNotFound 没有找到对应的消费队列
+	ErrConsumeQueueNotFound = errors.New("consume queue not found")
+
+	//ErrIndexDisabled 没有启用哈希索引
+	ErrIndexDisabled = errors.New("message index is disabled")
+)
+
+// MessageStore 在 commit log 之上为每个 topic 的每个队列维护消费队列
+// 所有记录顺序写入 commit log, 分发协程读取新写入的记录并写入消费队列的索引, 可以按照队列偏移量直接定位记录
+type MessageStore struct {
+	RootDir string
+
+	Config *StoreConfig
+
+	//保存所有记录的文件队列
+	CommitLog *MappedFileQueue
+
+	//所有文件所在的存储后端
+	storage Storage
+
+	//保护 consumeQueueTable
+	consumeQueueLock sync.RWMutex
+
+	//topic -> queueId -> 消费队列
+	consumeQueueTable map[string]map[int32]*ConsumeQueue
+
+	//保证队列偏移量的分配顺序与记录的写入顺序一致
+	putLock sync.Mutex
+
+	//topic-queueId -> 下一条记录的队列偏移量
+	topicQueueTable map[string]int64
+
+	//按照顺序执行的索引构建
+	dispatchers []CommitLogDispatcher
+
+	reputService *ReputService
+
+	flushConsumeQueueService *FlushConsumeQueueService
+
+	//业务主键的哈希索引, 没有启用时为nil
+	indexService *IndexService
+
+	//消费组的消费进度
+	offsetManager *ConsumerOffsetManager
+
+	//延迟记录的投递服务
+	scheduleService *ScheduleService
+}
+
+// NewMessageStore 创建 MessageStore, 已存在的数据需要通过 Load 加载
+func NewMessageStore(rootDir string, config *StoreConfig) *MessageStore {
+	storage := config.Storage
+	if storage == nil {
+		storage = defaultStorage
+	}
+
+	commitLog := NewMappedFileQueue(filepath.Join(rootDir, commitLogDirName), config.CommitLogFileSize)
+	commitLog.Config = config.CommitLog
+	commitLog.Storage = storage
+
+	store := &MessageStore{
+		RootDir:           rootDir,
+		Config:            config,
+		CommitLog:         commitLog,
+		storage:           storage,
+		consumeQueueTable: make(map[string]map[int32]*ConsumeQueue),
+		topicQueueTable:   make(map[string]int64),
+	}
+	store.dispatchers = []CommitLogDispatcher{&consumeQueueDispatcher{store: store}}
+	if config.MessageIndexEnable {
+		store.indexService = NewIndexService(storage, rootDir, config)
+		store.dispatchers = append(store.dispatchers, store.indexService)
+	}
+	store.offsetManager = NewConsumerOffsetManager(storage, filepath.Join(rootDir, configDirName, consumerOffsetFileName), config.FlushConsumerOffsetInterval)
+	store.reputService = NewReputService(store, config.ReputInterval)
+	store.flushConsumeQueueService = NewFlushConsumeQueueService(store, config)
+	store.scheduleService = NewScheduleService(store, config.ScheduleInterval)
+	return store
+}
+
+// Load 加载并恢复 commit log 与消费队列, 将 commit log 中还没有构建索引的记录重新分发
+func (this *MessageStore) Load() error {
+	if err := this.CommitLog.Load(); err != nil {
+		return err
+	}
+	this.CommitLog.Recover()
+
+	if err := this.loadConsumeQueues(); err != nil {
+		return err
+	}
+
+	if err := this.offsetManager.Load(); err != nil {
+		return err
+	}
+
+	if err := this.scheduleService.Load(this.Config.MessageDelayLevel); err != nil {
+		return err
+	}
+
+	//commit log 截断之后, 消费队列中指向被截断数据的索引也需要删除
+	maxPhysicOffset := this.CommitLog.GetMaxOffset()
+	reputFromOffset := this.CommitLog.GetMinOffset()
+	for _, cq := range this.getConsumeQueues() {
+		cq.Recover()
+		cq.TruncateDirtyEntries(maxPhysicOffset)
+		if cq.GetMaxPhysicOffset() > reputFromOffset {
+			reputFromOffset = cq.GetMaxPhysicOffset()
+		}
+	}
+
+	if this.indexService != nil {
+		if err := this.indexService.Load(this.CommitLog.checkpoint, maxPhysicOffset); err != nil {
+			return err
+		}
+
+		//索引需要重新构建时从更早的位置开始分发, 消费队列会忽略已经写入过的记录
+		if indexReputFromOffset := this.indexService.GetReputFromOffset(); indexReputFromOffset >= 0 && indexReputFromOffset < reputFromOffset {
+			reputFromOffset = indexReputFromOffset
+		}
+	}
+
+	this.reputService.setReputFromOffset(reputFromOffset)
+	this.reputService.doReput()
+
+	for _, cq := range this.getConsumeQueues() {
+		this.topicQueueTable[topicQueueKey(cq.Topic, cq.QueueId)] = cq.GetMaxOffsetInQueue()
+	}
+
+	Logger.Infof("加载MessageStore完成, commit log 写入位置: %d, 分发位置: %d", maxPhysicOffset, this.reputService.GetReputFromOffset())
+	return nil
+}
+
+// loadConsumeQueues 加载 consumequeue/topic/queueId 目录下的所有消费队列
+func (this *MessageStore) loadConsumeQueues() error {
+	rootDir := filepath.Join(this.RootDir, consumeQueueDirName)
+	topicEntries, err := this.storage.ReadDir(rootDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, topicEntry := range topicEntries {
+		if !topicEntry.IsDir() || !topicNamePattern.MatchString(topicEntry.Name()) {
+			continue
+		}
+
+		queueEntries, err := this.storage.ReadDir(filepath.Join(rootDir, topicEntry.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, queueEntry := range queueEntries {
+			queueId, err := strconv.ParseInt(queueEntry.Name(), 10, 32)
+			if !queueEntry.IsDir() || err != nil || queueId < 0 {
+				continue
+			}
+
+			if _, err := this.findConsumeQueue(topicEntry.Name(), int32(queueId), true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Start 启动 commit log 的后台服务、分发服务、消费队列的刷盘服务、消费进度的持久化与延迟记录的投递
+func (this *MessageStore) Start() {
+	this.CommitLog.Start()
+	this.reputService.Start()
+	this.flushConsumeQueueService.Start()
+	this.offsetManager.Start()
+	this.scheduleService.Start()
+}
+
+// Shutdown 停止所有服务, 停止前会将已经写入的记录分发, 并将 commit log、消费队列与索引刷盘
+// 索引刷盘的位置记录在 commit log 的检查点中, 因此需要在关闭 commit log 之前关闭索引
+func (this *MessageStore) Shutdown() {
+	//先停止投递, 投递写入的记录随后一起分发
+	this.scheduleService.Shutdown()
+	commitAll(this.CommitLog)
+	this.reputService.Shutdown()
+	this.flushConsumeQueueService.Shutdown()
+	this.offsetManager.Shutdown()
+
+	if this.indexService != nil {
+		this.indexService.Shutdown()
+	}
+
+	this.CommitLog.Shutdown()
+	for _, cq := range this.getConsumeQueues() {
+		cq.Shutdown()
+	}
+}
+
+// PutRecord 将记录写入 commit log, 同时为记录分配在所属队列中的偏移量
+// 设置了延迟级别的记录会被替换到 ScheduleTopic 中对应级别的队列, 到期之后再写入原始的 topic 与队列
+func (this *MessageStore) PutRecord(record *Record) (*AppendRecordResult, error) {
+	if !topicNamePattern.MatchString(record.Topic) || len(record.Topic) > maxTopicLength || record.Topic == ScheduleTopic {
+		return nil, ErrIllegalTopic
+	}
+
+	if record.QueueId < 0 {
+		return nil, ErrIllegalQueueId
+	}
+
+	if delayLevel := record.DelayTimeLevel(); delayLevel > 0 && this.scheduleService.GetMaxDelayLevel() > 0 {
+		this.scheduleService.toScheduleRecord(record, delayLevel)
+	}
+
+	if err := record.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := this.CommitLog.compressRecord(record); err != nil {
+		return nil, err
+	}
+
+	if this.CommitLog.isRecordTooLarge(int64(record.Size())) {
+		return nil, ErrRecordTooLarge
+	}
+
+	result, err := this.putRecordLocked(record)
+	if err != nil {
+		return nil, err
+	}
+
+	err = this.CommitLog.handleFlush(result)
+	this.reputService.Wakeup()
+	return result, err
+}
+
+// putRecordLocked 在锁内分配队列偏移量并写入 commit log, 写入失败时不占用偏移量
+func (this *MessageStore) putRecordLocked(record *Record) (*AppendRecordResult, error) {
+	key := topicQueueKey(record.Topic, record.QueueId)
+
+	this.putLock.Lock()
+	defer this.putLock.Unlock()
+
+	record.QueueOffset = this.topicQueueTable[key]
+	result, err := this.CommitLog.appendRecordLocked(record)
+	if err != nil {
+		return nil, err
+	}
+
+	this.topicQueueTable[key] = record.QueueOffset + 1
+	return result, nil
+}
+
+// GetRecord 读取 topic 下 queueId 队列中第 queueOffset 条记录, 使用完成后需要调用 Record.Release
+func (this *MessageStore) GetRecord(topic string, queueId int32, queueOffset int64) (*Record, error) {
+	cq, err := this.findConsumeQueue(topic, queueId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := cq.GetEntry(queueOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.CommitLog.ReadRecord(entry.CommitLogOffset)
+}
+
+// QueryByKey 根据业务主键查找写入时间在 [beginTime, endTime] 范围内的记录, 最多返回 maxResults 条, 按照写入顺序从新到旧排列
+// 返回的记录使用完成后需要调用 Record.Release
+func (this *MessageStore) QueryByKey(key string, maxResults int, beginTime int64, endTime int64) ([]*Record, error) {
+	if this.indexService == nil {
+		return nil, ErrIndexDisabled
+	}
+
+	records := make([]*Record, 0)
+	for _, phyOffset := range this.indexService.QueryOffsets(key, maxResults, beginTime, endTime) {
+		record, err := this.CommitLog.ReadRecord(phyOffset)
+		if err != nil {
+			//记录所在的文件已经被删除
+			continue
+		}
+
+		//哈希值相同的其他业务主键以及与查询范围处于同一秒但不在范围内的记录需要过滤掉
+		if !containsKey(record.Keys(), key) || record.StoreTimestamp < beginTime || record.StoreTimestamp > endTime {
+			record.Release()
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOffsetInQueueByTime 查找队列中第一条写入时间不早于 timestamp 的记录的偏移量, 所有记录都早于 timestamp 时返回最大偏移量
+// 队列中记录的写入时间是递增的, 根据索引条目读取 commit log 中记录的写入时间二分查找
+func (this *MessageStore) GetOffsetInQueueByTime(topic string, queueId int32, timestamp int64) (int64, error) {
+	cq, err := this.findConsumeQueue(topic, queueId, false)
+	if err != nil {
+		return 0, err
+	}
+
+	minOffset, maxOffset := cq.minOffsetInQueueFrom(this.CommitLog.GetMinOffset()), cq.GetMaxOffsetInQueue()
+	var searchErr error
+	index := sort.Search(int(maxOffset-minOffset), func(i int) bool {
+		storeTimestamp, err := this.getStoreTimestamp(cq, minOffset+int64(i))
+		if err != nil {
+			if searchErr == nil {
+				searchErr = err
+			}
+			return true
+		}
+		return storeTimestamp >= timestamp
+	})
+
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	return minOffset + int64(index), nil
+}
+
+// getStoreTimestamp 读取队列中第 queueOffset 条记录的写入时间, 空白条目视为最早的记录
+func (this *MessageStore) getStoreTimestamp(cq *ConsumeQueue, queueOffset int64) (int64, error) {
+	entry, err := cq.GetEntry(queueOffset)
+	if errors.Is(err, ErrBlankEntry) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	record, err := this.CommitLog.ReadRecord(entry.CommitLogOffset)
+	if err != nil {
+		return 0, err
+	}
+	defer record.Release()
+
+	return record.StoreTimestamp, nil
+}
+
+// GetMaxOffsetInQueue 队列中下一条记录的偏移量, 只包含已经构建索引的记录
+func (this *MessageStore) GetMaxOffsetInQueue(topic string, queueId int32) int64 {
+	cq, err := this.findConsumeQueue(topic, queueId, false)
+	if err != nil {
+		return 0
+	}
+
+	return cq.GetMaxOffsetInQueue()
+}
+
+// GetMinOffsetInQueue 队列中第一条没有被删除的记录的偏移量
+// 消费队列的文件不会被清理, commit log 中已经被删除的记录对应的索引条目不计算在内
+func (this *MessageStore) GetMinOffsetInQueue(topic string, queueId int32) int64 {
+	cq, err := this.findConsumeQueue(topic, queueId, false)
+	if err != nil {
+		return 0
+	}
+
+	return cq.minOffsetInQueueFrom(this.CommitLog.GetMinOffset())
+}
+
+// GetReputFromOffset 下一条需要构建索引的记录在 commit log 中的偏移量
+func (this *MessageStore) GetReputFromOffset() int64 {
+	return this.reputService.GetReputFromOffset()
+}
+
+// findConsumeQueue 查找消费队列, create 为true时不存在则创建
+func (this *MessageStore) findConsumeQueue(topic string, queueId int32, create bool) (*ConsumeQueue, error) {
+	this.consumeQueueLock.RLock()
+	cq, ok := this.consumeQueueTable[topic][queueId]
+	this.consumeQueueLock.RUnlock()
+	if ok {
+		return cq, nil
+	}
+
+	if !create {
+		return nil, ErrConsumeQueueNotFound
+	}
+
+	this.consumeQueueLock.Lock()
+	defer this.consumeQueueLock.Unlock()
+
+	if cq, ok := this.consumeQueueTable[topic][queueId]; ok {
+		return cq, nil
+	}
+
+	cq = NewConsumeQueue(this.storage, filepath.Join(this.RootDir, consumeQueueDirName), topic, queueId, this.Config.ConsumeQueueEntriesPerFile)
+	if err := cq.Load(); err != nil {
+		return nil, err
+	}
+
+	if this.consumeQueueTable[topic] == nil {
+		this.consumeQueueTable[topic] = make(map[int32]*ConsumeQueue)
+	}
+	this.consumeQueueTable[topic][queueId] = cq
+	return cq, nil
+}
+
+// getQueueIds 获取 topic 下所有队列的编号
+func (this *MessageStore) getQueueIds(topic string) []int32 {
+	this.consumeQueueLock.RLock()
+	defer this.consumeQueueLock.RUnlock()
+
+	queueIds := make([]int32, 0, len(this.consumeQueueTable[topic]))
+	for queueId := range this.consumeQueueTable[topic] {
+		queueIds = append(queueIds, queueId)
+	}
+	return queueIds
+}
+
+// getConsumeQueues 获取当前所有的消费队列
+func (this *MessageStore) getConsumeQueues() []*ConsumeQueue {
+	this.consumeQueueLock.RLock()
+	defer this.consumeQueueLock.RUnlock()
+
+	consumeQueues := make([]*ConsumeQueue, 0)
+	for _, queues := range this.consumeQueueTable {
+		for _, cq := range queues {
+			consumeQueues = append(consumeQueues, cq)
+		}
+	}
+	return consumeQueues
+}
+
+func topicQueueKey(topic string, queueId int32) string {
+	return fmt.Sprintf("%s-%d", topic, queueId)
+}
+
+// consumeQueueDispatcher 将记录的索引写入所属的消费队列
+type consumeQueueDispatcher struct {
+	store *MessageStore
+}
+
+func (dispatcher *consumeQueueDispatcher) Dispatch(request *DispatchRequest) {
+	if request.Topic == "" {
+		return
+	}
+
+	cq, err := dispatcher.store.findConsumeQueue(request.Topic, request.QueueId, true)
+	if err != nil {
+		Logger.Error("Create consume queue error: ", err)
+		return
+	}
+
+	if err := cq.PutEntry(request.QueueOffset, request.CommitLogOffset, request.Size, request.TagsCode); err != nil {
+		Logger.Errorf("Put consume queue %s-%d entry error: %v", request.Topic, request.QueueId, err)
+	}
+}
@@ -0,0 +1,339 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/spf13/afero"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStoreConfig() *StoreConfig {
+	config := DefaultStoreConfig()
+	config.CommitLogFileSize = 4 * 1024
+	config.ConsumeQueueEntriesPerFile = 8
+	config.IndexHashSlotNum = 8
+	config.IndexNum = 16
+	return config
+}
+
+func newTestMessageStore(t *testing.T, rootDir string) *MessageStore {
+	store := NewMessageStore(rootDir, newTestStoreConfig())
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	store.Start()
+	return store
+}
+
+func newTestTopicRecord(topic string, queueId int32, i int) *Record {
+	record := NewRecord(testBody(i))
+	record.Topic = topic
+	record.QueueId = queueId
+	record.PutProperty(PropertyTags, "tag")
+	return record
+}
+
+// waitForDispatch 等待所有写入的记录构建完索引
+func waitForDispatch(t *testing.T, store *MessageStore) {
+	deadline := time.Now().Add(time.Second)
+	for store.GetReputFromOffset() < store.CommitLog.GetMaxOffset() {
+		if time.Now().After(deadline) {
+			t.Fatalf("dispatch timeout, reput from %d, max offset %d", store.GetReputFromOffset(), store.CommitLog.GetMaxOffset())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessageStorePutAndGetRecord(t *testing.T) {
+	store := newTestMessageStore(t, t.TempDir())
+	defer store.Shutdown()
+
+	for i := 0; i < 60; i++ {
+		result, err := store.PutRecord(newTestTopicRecord("book", int32(i%2), i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.QueueOffset != int64(i/2) {
+			t.Fatalf("expect queue offset %d, got %d", i/2, result.QueueOffset)
+		}
+	}
+	waitForDispatch(t, store)
+
+	if maxOffset := store.GetMaxOffsetInQueue("book", 1); maxOffset != 30 {
+		t.Fatalf("expect max offset in queue 30, got %d", maxOffset)
+	}
+
+	record, err := store.GetRecord("book", 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer record.Release()
+
+	if !bytes.Equal(record.Body, testBody(41)) || record.Topic != "book" || record.Tags() != "tag" {
+		t.Fatalf("unexpected record %#v", record)
+	}
+
+	if _, err := store.PutRecord(newTestTopicRecord("../book", 0, 0)); err != ErrIllegalTopic {
+		t.Fatalf("expect illegal topic, got %v", err)
+	}
+
+	if _, err := store.GetRecord("page", 0, 0); err != ErrConsumeQueueNotFound {
+		t.Fatalf("expect consume queue not found, got %v", err)
+	}
+}
+
+func TestMessageStoreRebuildConsumeQueue(t *testing.T) {
+	rootDir := t.TempDir()
+	store := newTestMessageStore(t, rootDir)
+	for i := 0; i < 20; i++ {
+		if _, err := store.PutRecord(newTestTopicRecord("book", 0, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Shutdown()
+
+	//删除消费队列后重新加载, 索引从 commit log 中重新构建
+	if err := os.RemoveAll(filepath.Join(rootDir, consumeQueueDirName)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newTestMessageStore(t, rootDir)
+	defer reopened.Shutdown()
+
+	if maxOffset := reopened.GetMaxOffsetInQueue("book", 0); maxOffset != 20 {
+		t.Fatalf("expect max offset in queue 20, got %d", maxOffset)
+	}
+
+	//重新加载之后队列偏移量继续递增
+	result, err := reopened.PutRecord(newTestTopicRecord("book", 0, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.QueueOffset != 20 {
+		t.Fatalf("expect queue offset 20, got %d", result.QueueOffset)
+	}
+	waitForDispatch(t, reopened)
+
+	record, err := reopened.GetRecord("book", 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer record.Release()
+
+	if !bytes.Equal(record.Body, testBody(20)) {
+		t.Fatalf("unexpected record body %q", record.Body)
+	}
+}
+
+func TestMessageStoreQueryByKey(t *testing.T) {
+	rootDir := t.TempDir()
+	store := newTestMessageStore(t, rootDir)
+
+	for i := 0; i < 40; i++ {
+		record := newTestTopicRecord("book", 0, i)
+		record.PutProperty(PropertyKeys, fmt.Sprintf("sign-%d global-%d", i%4, i))
+		if _, err := store.PutRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForDispatch(t, store)
+
+	records, err := store.QueryByKey("sign-1", 5, 0, time.Now().UnixMilli())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || !bytes.Equal(records[0].Body, testBody(37)) {
+		t.Fatalf("unexpected query result count %d", len(records))
+	}
+	for _, record := range records {
+		record.Release()
+	}
+	store.Shutdown()
+
+	//重新加载之后索引仍然可以查询
+	reopened := newTestMessageStore(t, rootDir)
+	defer reopened.Shutdown()
+
+	records, err = reopened.QueryByKey("global-21", 5, 0, time.Now().UnixMilli())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, record := range records {
+			record.Release()
+		}
+	}()
+
+	if len(records) != 1 || !bytes.Equal(records[0].Body, testBody(21)) {
+		t.Fatalf("unexpected query result count %d", len(records))
+	}
+}
+
+func TestMessageStoreWithHeapStorage(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config := newTestStoreConfig()
+	config.Storage = NewHeapStorage(fs)
+
+	rootDir := filepath.Join(t.TempDir(), "store")
+	store := NewMessageStore(rootDir, config)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	store.Start()
+
+	for i := 0; i < 40; i++ {
+		record := newTestTopicRecord("book", int32(i%2), i)
+		record.PutProperty(PropertyKeys, fmt.Sprintf("global-%d", i))
+		if _, err := store.PutRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForDispatch(t, store)
+	store.offsetManager.CommitOffset("reader", "book", 1, 7)
+	store.Shutdown()
+
+	//所有文件都写入存储后端, 不会写入磁盘
+	if _, err := os.Stat(rootDir); !os.IsNotExist(err) {
+		t.Fatalf("expect no files on disk, got %v", err)
+	}
+
+	for _, dir := range []string{commitLogDirName, consumeQueueDirName, indexDirName, configDirName} {
+		if _, err := fs.Stat(filepath.Join(rootDir, dir)); err != nil {
+			t.Fatalf("expect %s in heap storage, got %v", dir, err)
+		}
+	}
+
+	//使用同一个存储后端重新加载, 消费队列、索引与消费进度都可以恢复
+	reopened := NewMessageStore(rootDir, config)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Start()
+	defer reopened.Shutdown()
+
+	if maxOffset := reopened.GetMaxOffsetInQueue("book", 1); maxOffset != 20 {
+		t.Fatalf("expect max offset in queue 20, got %d", maxOffset)
+	}
+
+	record, err := reopened.GetRecord("book", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer record.Release()
+
+	if !bytes.Equal(record.Body, testBody(21)) {
+		t.Fatalf("unexpected record body %q", record.Body)
+	}
+
+	records, err := reopened.QueryByKey("global-33", 5, 0, time.Now().UnixMilli())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, record := range records {
+			record.Release()
+		}
+	}()
+
+	if len(records) != 1 || !bytes.Equal(records[0].Body, testBody(33)) {
+		t.Fatalf("unexpected query result count %d", len(records))
+	}
+
+	if offset := reopened.offsetManager.QueryOffset("reader", "book", 1); offset != 7 {
+		t.Fatalf("expect consumer offset 7, got %d", offset)
+	}
+}
+
+func TestMessageStoreQueryByKeyBoundarySecond(t *testing.T) {
+	store := newTestMessageStore(t, t.TempDir())
+	defer store.Shutdown()
+
+	//索引条目中的时间只精确到秒, 查询范围的边界落在同一秒内时按照记录的写入时间过滤
+	var beginTimestamp int64 = 1_000_000
+	for i, timeDiff := range []int64{0, 1500, 2200} {
+		record := newTestTopicRecord("book", 0, i)
+		record.PutProperty(PropertyKeys, "sign")
+		record.StoreTimestamp = beginTimestamp + timeDiff
+		if _, err := store.PutRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForDispatch(t, store)
+
+	cases := []struct {
+		beginTime int64
+		endTime   int64
+		bodies    [][]byte
+	}{
+		{beginTimestamp + 2100, beginTimestamp + 3000, [][]byte{testBody(2)}},
+		{beginTimestamp + 1200, beginTimestamp + 2100, [][]byte{testBody(1)}},
+		{beginTimestamp, beginTimestamp + 2200, [][]byte{testBody(2), testBody(1), testBody(0)}},
+	}
+	for _, c := range cases {
+		records, err := store.QueryByKey("sign", 10, c.beginTime, c.endTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matched := len(records) == len(c.bodies)
+		for i := 0; matched && i < len(records); i++ {
+			matched = bytes.Equal(records[i].Body, c.bodies[i])
+		}
+		for _, record := range records {
+			record.Release()
+		}
+
+		if !matched {
+			t.Fatalf("unexpected query result count %d in [%d, %d]", len(records), c.beginTime, c.endTime)
+		}
+	}
+}
+
+func TestMessageStoreReputUnreadableRecord(t *testing.T) {
+	store := NewMessageStore(t.TempDir(), newTestStoreConfig())
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := make([]int64, 0, 5)
+	for i := 0; i < 5; i++ {
+		result, err := store.PutRecord(newTestTopicRecord("book", 0, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, result.WroteOffset)
+	}
+
+	//破坏第三条记录的内容, 分发停在该记录之前, 重试时不会跳过
+	region := store.CommitLog.getLastFile().region.Bytes()
+	//第三条记录的最后一个字节是记录内容
+	corruptPosition := offsets[3] - 1
+	region[corruptPosition] ^= 0xff
+	for i := 0; i < 2; i++ {
+		if err := store.reputService.doReput(); !errors.Is(err, ErrCRCMismatch) {
+			t.Fatalf("expect crc mismatch, got %v", err)
+		}
+
+		if store.GetReputFromOffset() != offsets[2] || store.reputService.errorOffset != offsets[2] {
+			t.Fatalf("expect reput to stop at %d, got %d", offsets[2], store.GetReputFromOffset())
+		}
+	}
+
+	//数据恢复之后继续分发
+	region[corruptPosition] ^= 0xff
+	if err := store.reputService.doReput(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.GetReputFromOffset() != store.CommitLog.GetMaxOffset() || store.reputService.errorOffset != -1 {
+		t.Fatalf("expect all records dispatched, got reput from %d", store.GetReputFromOffset())
+	}
+
+	store.Start()
+	store.Shutdown()
+}
@@ -2,29 +2,50 @@ package store
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/edsrzf/mmap-go"
-	"k8s.io/apimachinery/pkg/util/errors"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
-	"turing/resolve/statics"
+	"time"
+)
+
+var (
+	//ErrMappedFileUnavailable 文件已经关闭, 不能再读取
+	ErrMappedFileUnavailable = errors.New("mapped file is unavailable")
+
+	//ErrMappedFileInUse 文件仍然被读取方持有, 暂时不能删除
+	ErrMappedFileInUse = errors.New("mapped file is in use")
 )
 
 var (
 	//fileSize 文件大小为1M
 	fileSize int64 = 1 << 20
+
+	//pageSize 操作系统内存页大小
+	pageSize = int64(os.Getpagesize())
+
+	//defaultStorage 没有指定存储后端时使用内存映射
+	defaultStorage Storage = NewMmapStorage()
 )
 
 type MappedFile struct {
-	File *os.File
+	//引用计数, 计数减为0时解除映射
+	ReferenceResource
 
 	FileName string
 
 	//文件大小
 	FileSize int64
 
-	mmapRegion *mmap.MMap
+	//文件所在的存储后端
+	storage Storage
+
+	//文件映射到内存的区域
+	region Region
 
 	//刷盘位置
 	flushPosition int64
@@ -32,28 +53,303 @@ type MappedFile struct {
 	//写入磁盘位置
 	writePosition int64
 
-	//读写锁
-	rwLock *sync.RWMutex
+	//提交位置, 使用写入缓冲区时只有提交到映射区域的数据才能被读取与刷盘
+	committedPosition int64
+
+	//写入缓冲区, 为nil时直接写入映射区域
+	writeBuffer []byte
+
+	//写入缓冲区所属的缓冲池, 文件写满或者关闭后归还缓冲区
+	transientStorePool *TransientStorePool
+
+	//保证同一时刻只有一个协程在提交
+	commitLock sync.Mutex
+
+	//追加锁, 保证写入位置的分配与数据拷贝是一个整体
+	appendLock sync.Mutex
 
 	//文件写入的起始位置
 	fileFromOffset int64
+
+	//最后一次写入的时间, 毫秒
+	lastModifiedTimestamp int64
+
+	//最后一条记录的写入时间, 毫秒, 为0时需要从文件中读取
+	lastStoreTimestamp int64
 }
 
-func (this *MappedFile) Write(offset int64, bytes []byte) {
+func (this *MappedFile) Write(offset int64, bytes []byte) error {
 	writeLen := len(bytes)
-	region := *this.mmapRegion
+	if offset < 0 || offset+int64(writeLen) > this.FileSize {
+		return ErrInsufficientSpace
+	}
+
+	region := this.region.Bytes()
 	copy(region[offset:int(offset)+len(bytes)], bytes)
 
 	//计算写如长度
 	atomic.AddInt64(&this.writePosition, int64(writeLen))
+	atomic.StoreInt64(&this.lastModifiedTimestamp, time.Now().UnixMilli())
+	return nil
+}
+
+// GetLastModifiedTimestamp 最后一次写入的时间, 毫秒
+func (this *MappedFile) GetLastModifiedTimestamp() int64 {
+	return atomic.LoadInt64(&this.lastModifiedTimestamp)
+}
+
+// IsInUse 除创建时的引用之外是否还有读取方持有该文件
+func (this *MappedFile) IsInUse() bool {
+	return this.GetRefCount() > 1
+}
+
+// Append 在写入位置追加数据, 返回数据在文件中的位置, 剩余空间不足时返回 ErrInsufficientSpace
+func (this *MappedFile) Append(bytes []byte) (int64, error) {
+	this.appendLock.Lock()
+	defer this.appendLock.Unlock()
+
+	writePos := this.GetWritePosition()
+	if writePos+int64(len(bytes)) > this.FileSize {
+		return 0, ErrInsufficientSpace
+	}
+
+	this.appendAt(writePos, bytes)
+	return writePos, nil
+}
+
+// appendAt 在已分配的写入位置拷贝数据, 数据拷贝完成之后才更新写入位置, 读取方不会读到未写完的数据
+func (this *MappedFile) appendAt(writePos int64, bytes []byte) {
+	copy(this.appendRegion()[writePos:], bytes)
+	atomic.StoreInt64(&this.writePosition, writePos+int64(len(bytes)))
+	atomic.StoreInt64(&this.lastModifiedTimestamp, time.Now().UnixMilli())
+}
+
+// AppendRecordResult 记录写入的结果
+type AppendRecordResult struct {
+	//记录的全局偏移量
+	WroteOffset int64
+	//写入的字节数
+	WroteBytes     int
+	StoreTimestamp int64
+	//记录在逻辑队列中的偏移量
+	QueueOffset int64
+}
+
+// AppendRecord 在文件末尾追加一条记录
+// 记录之后的剩余空间必须能够容纳文件结束标记, 否则写入文件结束标记并将文件标记为已写满, 返回 ErrInsufficientSpace
+func (this *MappedFile) AppendRecord(record *Record) (*AppendRecordResult, error) {
+	this.appendLock.Lock()
+	defer this.appendLock.Unlock()
+
+	writePos := this.GetWritePosition()
+	remaining := this.FileSize - writePos
+	recordSize := int64(record.Size())
+	if recordSize != remaining && recordSize+blankMarkerSize > remaining {
+		this.appendBlankMarker(writePos)
+		return nil, ErrInsufficientSpace
+	}
+
+	this.appendAt(writePos, record.Encode())
+	atomic.StoreInt64(&this.lastStoreTimestamp, record.StoreTimestamp)
+	return &AppendRecordResult{
+		WroteOffset:    this.fileFromOffset + writePos,
+		WroteBytes:     int(record.TotalSize),
+		StoreTimestamp: record.StoreTimestamp,
+		QueueOffset:    record.QueueOffset,
+	}, nil
+}
+
+// appendRecords 将已经编码的多条记录拼接之后一次写入文件末尾, 返回第一条记录的写入位置与写入的记录数量
+// 只写入能够放下的前缀, 与 AppendRecord 相同, 一条记录都放不下时写入文件结束标记并返回 ErrInsufficientSpace
+// 空文件也放不下第一条记录时不写入结束标记, 返回 ErrRecordTooLarge, 避免调用方不断切换到新的文件
+func (this *MappedFile) appendRecords(encoded [][]byte, storeTimestamp int64) (int64, int, error) {
+	this.appendLock.Lock()
+	defer this.appendLock.Unlock()
+
+	writePos := this.GetWritePosition()
+	remaining := this.FileSize - writePos
+	var batchSize int64
+	count := 0
+	for _, data := range encoded {
+		size := batchSize + int64(len(data))
+		if size != remaining && size+blankMarkerSize > remaining {
+			break
+		}
+		batchSize = size
+		count++
+	}
+
+	if count == 0 && writePos == 0 {
+		return 0, 0, ErrRecordTooLarge
+	}
+
+	if count == 0 {
+		this.appendBlankMarker(writePos)
+		return 0, 0, ErrInsufficientSpace
+	}
+
+	batch := make([]byte, 0, batchSize)
+	for _, data := range encoded[:count] {
+		batch = append(batch, data...)
+	}
+
+	this.appendAt(writePos, batch)
+	atomic.StoreInt64(&this.lastStoreTimestamp, storeTimestamp)
+	return writePos, count, nil
+}
+
+// MappedBuffer 文件映射区域的一段视图, 持有期间文件不会被解除映射, 使用完成后必须调用 Release
+type MappedBuffer struct {
+	//视图起始位置的全局偏移量
+	StartOffset int64
+
+	Data []byte
+
+	mappedFile *MappedFile
+}
+
+// Release 释放视图对文件的引用, 释放后不能再访问 Data
+func (buffer *MappedBuffer) Release() {
+	if buffer.mappedFile != nil {
+		buffer.mappedFile.Release()
+		buffer.mappedFile = nil
+		buffer.Data = nil
+	}
 }
 
-func (this *MappedFile) Append(bytes []byte) {
-	this.Write(this.writePosition, bytes)
+// SelectMappedBuffer 获取从 position 开始最多 size 个可读取字节的视图, size 小于0时读取到可读取的位置
+func (this *MappedFile) SelectMappedBuffer(position int64, size int) (*MappedBuffer, error) {
+	writePos := this.GetReadPosition()
+	if position < 0 || position >= writePos || size == 0 {
+		return nil, ErrNoMoreRecord
+	}
+
+	end := writePos
+	if size > 0 && position+int64(size) < writePos {
+		end = position + int64(size)
+	}
+
+	if !this.Hold() {
+		return nil, ErrMappedFileUnavailable
+	}
+
+	return &MappedBuffer{
+		StartOffset: this.fileFromOffset + position,
+		Data:        this.region.Bytes()[position:end],
+		mappedFile:  this,
+	}, nil
+}
+
+// ReadRecord 读取文件中 position 位置的记录
+// 记录内容直接引用映射区域, 压缩的记录内容为解压之后的拷贝, 使用完成后需要调用 Record.Release
+func (this *MappedFile) ReadRecord(position int64) (*Record, error) {
+	buffer, err := this.SelectMappedBuffer(position, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := DecodeRecord(buffer.Data)
+	if err != nil {
+		buffer.Release()
+		return nil, err
+	}
+
+	record.buffer = buffer
+	return record, nil
+}
+
+// ReadBytes 从 position 位置开始读取最多 size 个已写入的字节, 返回拷贝后的数据
+func (this *MappedFile) ReadBytes(position int64, size int) []byte {
+	buffer, err := this.SelectMappedBuffer(position, size)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	defer buffer.Release()
+
+	return append([]byte(nil), buffer.Data...)
+}
+
+// GetFirstTimestamp 文件中第一条记录的写入时间, 文件中没有记录时返回 ErrNoMoreRecord
+func (this *MappedFile) GetFirstTimestamp() (int64, error) {
+	record, err := this.ReadRecord(0)
+	if err == ErrEndOfFile {
+		return 0, ErrNoMoreRecord
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	defer record.Release()
+
+	return record.StoreTimestamp, nil
 }
 
-func (this *MappedFile) AppendString(dataStr string) {
-	this.WriteString(this.writePosition, dataStr)
+// GetLastTimestamp 文件中最后一条记录的写入时间, 文件中没有记录时返回 ErrNoMoreRecord
+// 写入过或者启动恢复时校验过的文件直接返回记录的时间, 否则从文件头开始顺序读取
+func (this *MappedFile) GetLastTimestamp() (int64, error) {
+	if lastTimestamp := atomic.LoadInt64(&this.lastStoreTimestamp); lastTimestamp > 0 {
+		return lastTimestamp, nil
+	}
+
+	var position int64 = 0
+	var lastTimestamp int64 = -1
+	for {
+		record, err := this.ReadRecord(position)
+		if err == ErrEndOfFile || err == ErrNoMoreRecord {
+			break
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		lastTimestamp = record.StoreTimestamp
+		position += int64(record.TotalSize)
+		record.Release()
+	}
+
+	if lastTimestamp < 0 {
+		return 0, ErrNoMoreRecord
+	}
+
+	atomic.CompareAndSwapInt64(&this.lastStoreTimestamp, 0, lastTimestamp)
+	return lastTimestamp, nil
+}
+
+// checkRecord 校验 position 位置的记录, 不受写入位置限制, 用于启动恢复
+func (this *MappedFile) checkRecord(position int64) (*Record, error) {
+	return decodeRecord(this.region.Bytes()[position:])
+}
+
+// recoverValidLength 从文件头开始逐条校验记录, 返回最后一条完整记录的结束位置
+// 同时记录最后一条完整记录的写入时间, 之后按照时间查找时不需要再次读取文件
+func (this *MappedFile) recoverValidLength() int64 {
+	var position int64 = 0
+	var lastTimestamp int64 = 0
+	for position < this.FileSize {
+		record, err := this.checkRecord(position)
+		if err == ErrEndOfFile {
+			//读到文件结束标记说明文件已经写满
+			position = this.FileSize
+			break
+		}
+
+		if err != nil {
+			if err != ErrNoMoreRecord {
+				Logger.Warnf("MappedFile %s 在位置 %d 的记录校验失败: %v", this.FileName, position, err)
+			}
+			break
+		}
+		lastTimestamp = record.StoreTimestamp
+		position += int64(record.TotalSize)
+	}
+
+	atomic.StoreInt64(&this.lastStoreTimestamp, lastTimestamp)
+	return position
+}
+
+func (this *MappedFile) AppendString(dataStr string) (int64, error) {
+	return this.Append([]byte(dataStr))
 }
 
 func (this *MappedFile) WriteString(offset int64, dataStr string) {
@@ -61,102 +357,357 @@ func (this *MappedFile) WriteString(offset int64, dataStr string) {
 }
 
 func (this *MappedFile) PutInt64(offset int, i int64) {
-	binary.BigEndian.PutUint64((*this.mmapRegion)[offset:offset+8], uint64(i))
-	this.writePosition += 6
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, uint64(i))
+	this.Write(int64(offset), bytes)
 }
 
 func (this *MappedFile) PutInt32(offset int, i int32) {
-	binary.BigEndian.PutUint32((*this.mmapRegion)[offset:offset+4], uint32(i))
-	this.writePosition += 4
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, uint32(i))
+	this.Write(int64(offset), bytes)
 }
 
 func (this *MappedFile) PutInt16(offset int, i int16) {
-	binary.BigEndian.PutUint16((*this.mmapRegion)[offset:offset+2], uint16(i))
-	this.writePosition += 2
+	bytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(bytes, uint16(i))
+	this.Write(int64(offset), bytes)
 }
 
-func (this *MappedFile) AppendInt64(i int64) {
-	writePos := this.writePosition
-	this.PutInt64(int(writePos), i)
+func (this *MappedFile) AppendInt64(i int64) (int64, error) {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, uint64(i))
+	return this.Append(bytes)
 }
 
-func (this *MappedFile) AppendInt32(i int32) {
-	writePos := this.writePosition
-	this.PutInt32(int(writePos), i)
+func (this *MappedFile) AppendInt32(i int32) (int64, error) {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, uint32(i))
+	return this.Append(bytes)
 }
 
-func (this *MappedFile) AppendInt16(i int16) {
-	writePos := this.writePosition
-	this.PutInt16(int(writePos), i)
+func (this *MappedFile) AppendInt16(i int16) (int64, error) {
+	bytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(bytes, uint16(i))
+	return this.Append(bytes)
 }
 
-func (this *MappedFile) Flush() {
-	err := this.mmapRegion.Flush()
-	if err != nil {
-		statics.Logger.Error(err)
+// appendRegion 追加数据的目标区域, 使用写入缓冲区时写入缓冲区, 否则直接写入映射区域, 需要持有 appendLock
+func (this *MappedFile) appendRegion() []byte {
+	if this.writeBuffer != nil {
+		return this.writeBuffer
+	}
+
+	return this.region.Bytes()
+}
+
+// appendBlankMarker 在 writePos 写入文件结束标记并将文件标记为已写满
+// 结束标记的长度为文件的剩余空间, 读取方读到结束标记后跳到下一个文件
+func (this *MappedFile) appendBlankMarker(writePos int64) {
+	if writePos < this.FileSize {
+		copy(this.appendRegion()[writePos:], encodeBlankMarker(int32(this.FileSize-writePos)))
+	}
+
+	atomic.StoreInt64(&this.writePosition, this.FileSize)
+	atomic.StoreInt64(&this.lastModifiedTimestamp, time.Now().UnixMilli())
+}
+
+// WarmUp 预热文件: 预先分配磁盘空间并逐页写入, 避免第一次写入时产生缺页中断
+// 每写入 yieldPages 个内存页让出一次CPU, 可选通知内核预读并锁定内存
+// 存储后端不支持预分配、预读与锁定内存时只逐页写入
+func (this *MappedFile) WarmUp(yieldPages int, willNeed bool, lockMemory bool) error {
+	if !this.Hold() {
+		return ErrMappedFileUnavailable
+	}
+	defer this.Release()
+
+	startTime := time.Now()
+	warmUpRegion, warmUpSupported := this.region.(WarmUpRegion)
+	if warmUpSupported {
+		if err := warmUpRegion.Fallocate(); err != nil {
+			return err
+		}
+	}
+
+	if warmUpSupported && willNeed {
+		if err := warmUpRegion.WillNeed(); err != nil {
+			Logger.Warnf("MappedFile %s madvise error: %v", this.FileName, err)
+		}
+	}
+
+	region := this.region.Bytes()
+	pages := 0
+	for i := int64(0); i < this.FileSize; i += pageSize {
+		//写回原有的值, 文件中已经存在的数据不会被改变
+		value := region[i]
+		region[i] = value
+		pages++
+		if yieldPages > 0 && pages%yieldPages == 0 {
+			runtime.Gosched()
+		}
+	}
+
+	if warmUpSupported && lockMemory {
+		if err := warmUpRegion.Lock(); err != nil {
+			Logger.Warnf("MappedFile %s mlock error: %v", this.FileName, err)
+		}
+	}
+
+	Logger.Infof("预热MappedFile %s 完成, 耗时: %v", this.FileName, time.Since(startTime))
+	return nil
+}
+
+// Commit 将写入缓冲区中尚未提交的数据拷贝到映射区域, 返回是否有数据被提交
+// 提交的数据达到 commitLeastPages 个内存页时才会提交, 文件写满之后归还写入缓冲区
+func (this *MappedFile) Commit(commitLeastPages int) bool {
+	if this.transientStorePool == nil || !this.IsAbleToCommit(commitLeastPages) {
+		return false
+	}
+
+	if !this.Hold() {
+		return false
+	}
+	defer this.Release()
+
+	this.commitLock.Lock()
+	defer this.commitLock.Unlock()
+
+	//写入缓冲区只会在提交协程中归还, 提交过程中不会被修改
+	if this.writeBuffer == nil {
+		return false
+	}
+
+	committedPos := this.GetCommittedPosition()
+	writePos := this.GetWritePosition()
+	copy(this.region.Bytes()[committedPos:writePos], this.writeBuffer[committedPos:writePos])
+	atomic.StoreInt64(&this.committedPosition, writePos)
+
+	if writePos == this.FileSize {
+		this.returnWriteBuffer()
+	}
+	return true
+}
+
+// IsAbleToCommit 判断未提交的数据是否达到 commitLeastPages 个内存页, commitLeastPages 为0时只要有数据未提交即可
+func (this *MappedFile) IsAbleToCommit(commitLeastPages int) bool {
+	committedPos := this.GetCommittedPosition()
+	writePos := this.GetWritePosition()
+	if this.IsFull() || commitLeastPages <= 0 {
+		return writePos > committedPos
+	}
+
+	return (writePos/pageSize)-(committedPos/pageSize) >= int64(commitLeastPages)
+}
+
+// returnWriteBuffer 将写入缓冲区归还到缓冲池, 之后的写入直接写入映射区域
+func (this *MappedFile) returnWriteBuffer() {
+	this.appendLock.Lock()
+	writeBuffer := this.writeBuffer
+	this.writeBuffer = nil
+	this.appendLock.Unlock()
+
+	if writeBuffer != nil {
+		this.transientStorePool.ReturnBuffer(writeBuffer)
+	}
+}
+
+// Flush 将可读取的数据刷盘, 刷盘失败时返回错误并且不推进刷盘位置
+func (this *MappedFile) Flush() error {
+	if !this.Hold() {
+		return ErrMappedFileUnavailable
+	}
+	defer this.Release()
+
+	//刷盘之前记录可读取的位置, 刷盘过程中新写入的数据留到下一次刷盘
+	flushPos := this.GetFlushPosition()
+	writePos := this.GetReadPosition()
+	if err := this.region.Flush(flushPos, writePos-flushPos); err != nil {
+		return err
 	}
 
 	//计算写如长度
-	atomic.CompareAndSwapInt64(&this.flushPosition, this.flushPosition, this.writePosition)
+	atomic.StoreInt64(&this.flushPosition, writePos)
+	return nil
 }
 
-func (this MappedFile) String() string {
-	return fmt.Sprintf("%s", *this.mmapRegion)
+// IsAbleToFlush 判断脏页数量是否达到 flushLeastPages, flushLeastPages 为0时只要有数据未刷盘即可
+func (this *MappedFile) IsAbleToFlush(flushLeastPages int) bool {
+	flushPos := this.GetFlushPosition()
+	writePos := this.GetReadPosition()
+	if this.IsFull() || flushLeastPages <= 0 {
+		return writePos > flushPos
+	}
+
+	return (writePos/pageSize)-(flushPos/pageSize) >= int64(flushLeastPages)
 }
 
-func (this MappedFile) Close() error {
+func (this *MappedFile) String() string {
+	return fmt.Sprintf("%s", this.region.Bytes())
+}
 
-	compositeError := make([]error, 0)
-	err := this.mmapRegion.Flush()
+// Close 提交并刷盘后关闭文件映射, 仍有读取方持有文件时等到全部释放之后才会解除映射
+func (this *MappedFile) Close() error {
+	var err error
+	if this.Hold() {
+		this.Commit(0)
+		flushPos := this.GetFlushPosition()
+		writePos := this.GetReadPosition()
+		err = this.region.Flush(flushPos, writePos-flushPos)
+		if err == nil {
+			atomic.StoreInt64(&this.flushPosition, writePos)
+		}
+		this.Release()
+	}
 
-	if err != nil {
-		compositeError = append(compositeError, err)
-	} else {
-		//计算写如长度
-		atomic.CompareAndSwapInt64(&this.flushPosition, this.flushPosition, this.writePosition)
+	this.Shutdown(0)
+	return err
+}
+
+// Destroy 关闭映射并删除磁盘上的文件
+// 仍有读取方持有文件时返回 ErrMappedFileInUse, 距离第一次调用超过 intervalForcibly 后强制删除
+func (this *MappedFile) Destroy(intervalForcibly time.Duration) error {
+	this.Shutdown(intervalForcibly)
+	if !this.IsCleanupOver() {
+		return ErrMappedFileInUse
 	}
-	unmapError := this.mmapRegion.Unmap()
-	if unmapError != nil {
-		compositeError = append(compositeError, err)
+
+	if err := this.storage.Remove(this.FileName); err != nil {
+		return err
 	}
 
-	return errors.NewAggregate(compositeError)
+	Logger.Infof("删除MappedFile: %s", this.FileName)
+	return nil
+}
+
+// unmap 引用计数减为0时解除映射并关闭文件, 同时归还没有归还的写入缓冲区
+func (this *MappedFile) unmap() {
+	if this.transientStorePool != nil {
+		this.returnWriteBuffer()
+	}
+
+	if err := this.region.Close(); err != nil {
+		Logger.Error("Unmap MappedFile error: ", err)
+	}
+}
+
+// GetFileFromOffset 获取文件的起始偏移量
+func (this *MappedFile) GetFileFromOffset() int64 {
+	return this.fileFromOffset
+}
+
+// GetWritePosition 获取文件当前的写入位置
+func (this *MappedFile) GetWritePosition() int64 {
+	return atomic.LoadInt64(&this.writePosition)
+}
+
+// SetWritePosition 重置文件的写入位置，用于启动恢复
+func (this *MappedFile) SetWritePosition(position int64) {
+	atomic.StoreInt64(&this.writePosition, position)
+	atomic.StoreInt64(&this.committedPosition, position)
+}
+
+// GetCommittedPosition 获取文件当前的提交位置
+func (this *MappedFile) GetCommittedPosition() int64 {
+	return atomic.LoadInt64(&this.committedPosition)
+}
+
+// GetReadPosition 获取文件可以读取的位置, 使用写入缓冲区时为提交位置, 否则为写入位置
+func (this *MappedFile) GetReadPosition() int64 {
+	if this.transientStorePool == nil {
+		return this.GetWritePosition()
+	}
+
+	return this.GetCommittedPosition()
+}
+
+// GetFlushPosition 获取文件当前的刷盘位置
+func (this *MappedFile) GetFlushPosition() int64 {
+	return atomic.LoadInt64(&this.flushPosition)
+}
+
+// SetFlushPosition 重置文件的刷盘位置，用于启动恢复
+func (this *MappedFile) SetFlushPosition(position int64) {
+	atomic.StoreInt64(&this.flushPosition, position)
 }
 
-func (this MappedFile) IsFull() bool {
-	return this.writePosition == this.FileSize
+func (this *MappedFile) IsFull() bool {
+	return this.GetWritePosition() == this.FileSize
 }
 
-func NewMappedFile(fileName string, fileSize int64, deleteIfExists bool) *MappedFile {
-	file, err := openOrCreateFile(fileName, deleteIfExists)
+// NewMappedFile 使用内存映射打开或者创建文件
+func NewMappedFile(fileName string, fileSize int64, deleteIfExists bool) (*MappedFile, error) {
+	return NewMappedFileWithStorage(defaultStorage, fileName, fileSize, deleteIfExists)
+}
+
+// NewMappedFileWithStorage 在存储后端中打开或者创建文件, 文件名即为文件的起始偏移量
+func NewMappedFileWithStorage(storage Storage, fileName string, fileSize int64, deleteIfExists bool) (*MappedFile, error) {
+	fileFromOffset, err := strconv.ParseInt(filepath.Base(fileName), 10, 64)
 	if err != nil {
-		statics.Logger.Error("Get file err: ", err)
+		return nil, fmt.Errorf("invalid mapped file name %s: %w", fileName, err)
 	}
-	statics.Logger.Info("创建MappedFile开始")
-	mappedRegion, err := mmap.MapRegion(file, int(fileSize), mmap.RDWR, 0, 0)
 
+	Logger.Info("创建MappedFile开始")
+	region, err := storage.OpenRegion(fileName, fileSize, deleteIfExists)
 	if err != nil {
-		statics.Logger.Error("Create mapped buffer error: ", err)
+		Logger.Error("Create mapped region error: ", err)
+		return nil, err
+	}
+
+	var lastModifiedTimestamp int64
+	if stat, err := storage.Stat(fileName); err == nil {
+		lastModifiedTimestamp = stat.ModTime().UnixMilli()
 	}
 
 	mappedFile := &MappedFile{
-		mmapRegion: &mappedRegion,
-		FileName:   fileName,
-		FileSize:   fileSize,
-		File:       file,
+		FileName:              fileName,
+		FileSize:              fileSize,
+		storage:               storage,
+		region:                region,
+		fileFromOffset:        fileFromOffset,
+		lastModifiedTimestamp: lastModifiedTimestamp,
+	}
+	mappedFile.ReferenceResource = newReferenceResource(mappedFile.unmap)
+	Logger.Info("创建MappedFile结束")
+	return mappedFile, nil
+}
+
+// NewTransientMappedFile 创建使用写入缓冲区的 MappedFile, pool 为nil或者没有空闲的缓冲区时直接写入映射区域
+func NewTransientMappedFile(storage Storage, fileName string, fileSize int64, pool *TransientStorePool) (*MappedFile, error) {
+	mappedFile, err := NewMappedFileWithStorage(storage, fileName, fileSize, false)
+	if err != nil || pool == nil {
+		return mappedFile, err
+	}
+
+	writeBuffer := pool.BorrowBuffer()
+	if writeBuffer == nil {
+		Logger.Warnf("TransientStorePool 没有空闲的缓冲区, MappedFile %s 直接写入映射区域", fileName)
+		return mappedFile, nil
+	}
+
+	mappedFile.writeBuffer = writeBuffer
+	mappedFile.transientStorePool = pool
+	return mappedFile, nil
+}
+
+// ensureFileSize 保证文件长度与映射长度一致, 文件比映射长度大时说明文件不属于当前队列
+func ensureFileSize(file *os.File, fileSize int64) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() > fileSize {
+		return fmt.Errorf("file %s size %d is larger than mapped size %d", file.Name(), stat.Size(), fileSize)
+	}
+
+	if stat.Size() < fileSize {
+		return file.Truncate(fileSize)
 	}
 
-	//stat, err := file.Stat()
-	//size := stat.Size()
-	//重置当前文件的writePosition 与 writePosition
-	mappedFile.writePosition = 0
-	mappedFile.flushPosition = mappedFile.writePosition
-	statics.Logger.Info("创建MappedFile结束")
-	return mappedFile
+	return nil
 }
 
 func openOrCreateFile(fileName string, deleteIfExists bool) (*os.File, error) {
-	var file *os.File
 	if deleteIfExists {
 		file, err := os.Create(fileName)
 		if err != nil {
@@ -165,21 +716,10 @@ func openOrCreateFile(fileName string, deleteIfExists bool) (*os.File, error) {
 		return file, nil
 	}
 
-	_, err := os.Stat(fileName)
-
+	//不能先判断文件是否存在再调用 os.Create, 并发创建同一个文件时 os.Create 会清空已经写入的数据
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		if _, ok := err.(*os.PathError); ok || err == os.ErrNotExist {
-			statics.Logger.Info("创建新的文件")
-			file, err = os.Create(fileName)
-			if err != nil {
-				return nil, err
-			}
-		}
-	} else {
-		file, err = os.OpenFile(fileName, os.O_RDWR, os.ModePerm)
-		if err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
 	return file, nil
 }
@@ -1,133 +1,863 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/panjf2000/ants/v2"
 	"path/filepath"
-	"strings"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
-	"turing/resolve/statics"
 )
 
 var (
-	poolSize                         = 1 << 3
-	allocateService *AllocateService = &AllocateService{}
+	//mappedFileNamePattern MappedFile 文件名为20位的起始偏移量
+	mappedFileNamePattern = regexp.MustCompile(`^\d{20}$`)
+
+	//ErrRecordTooLarge 记录长度超过了单个文件能够容纳的长度
+	ErrRecordTooLarge = errors.New("record is larger than mapped file size")
+
+	//ErrOffsetOutOfRange 读取的偏移量不在队列的有效范围内
+	ErrOffsetOutOfRange = errors.New("offset out of range")
+
+	//ErrOffsetDeleted 偏移量所在的文件已经被删除
+	ErrOffsetDeleted = errors.New("offset has been deleted")
+
+	//ErrOffsetBeyondMax 偏移量超出了队列的写入位置
+	ErrOffsetBeyondMax = errors.New("offset is beyond the write position")
 )
 
-type AllocateRequest struct {
-	FileName   string
-	stopSh     chan struct{}
-	mappedFile *MappedFile
-	fileSize   int64
+// OffsetError 根据偏移量查找文件失败时返回的错误
+// 可以通过 errors.Is 判断具体的原因, 所有的 OffsetError 同时也是 ErrOffsetOutOfRange
+type OffsetError struct {
+	Offset    int64
+	MinOffset int64
+	MaxOffset int64
+	Err       error
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("%v: offset %d, min offset %d, max offset %d", e.Err, e.Offset, e.MinOffset, e.MaxOffset)
 }
 
-func (req AllocateRequest) Done() <-chan struct{} {
-	return req.stopSh
+func (e *OffsetError) Unwrap() error {
+	return e.Err
 }
 
-func (req AllocateRequest) Stop() {
-	req.stopSh <- struct{}{}
-	close(req.stopSh)
+func (e *OffsetError) Is(target error) bool {
+	return target == ErrOffsetOutOfRange
 }
 
-func NewAllocateRequest(fileName string) *AllocateRequest {
-	return &AllocateRequest{
-		FileName: fileName,
-		stopSh:   make(chan struct{}),
+type MappedFileQueue struct {
+	//文件目录
+	FileDir string
+
+	//文件的存储后端, 需要在 Load 之前设置
+	Storage Storage
+	//目录下的所有mmapFile文件
+	mappedFiles []*MappedFile
+	//保护 mappedFiles, 文件只会在末尾追加或整体替换, 读取方拿到的切片可以无锁使用
+	filesLock sync.RWMutex
+	//flush的位置，对于所有的文件而言
+	flushWhere int64
+	//每个文件的大小
+	FileSize int64
+
+	Config *QueueConfig
+
+	//写入锁, 保证同一时刻只有一个写入方
+	putLock PutLock
+
+	flushService FlushService
+
+	//提交服务, 只在启用写入缓冲池时启动
+	commitService *CommitRealTimeService
+
+	//写入缓冲池, 只在启用时创建
+	transientStorePool *TransientStorePool
+
+	//提交的位置, 对于所有的文件而言
+	committedWhere int64
+
+	cleanService *CleanService
+
+	//后台创建文件的服务, 没有启动时在写入协程中直接创建文件
+	allocateService *AllocateService
+
+	//检查点, 在 Load 时打开
+	checkpoint *Checkpoint
+
+	//上一次运行是否异常退出
+	abnormalShutdown bool
+
+	//可以读取的数据增加时唤醒等待新数据的协程
+	arriving ArrivingNotifier
+}
+
+// NewMappedFileQueue 创建 MappedFileQueue, 已存在的文件需要通过 Load 与 Recover 加载
+func NewMappedFileQueue(fileDir string, fileSize int64) *MappedFileQueue {
+	config := DefaultQueueConfig()
+	return &MappedFileQueue{
+		FileDir:     fileDir,
+		Storage:     defaultStorage,
+		FileSize:    fileSize,
+		mappedFiles: make([]*MappedFile, 0),
+		Config:      config,
+		putLock:     NewPutLock(config.PutLockType),
 	}
 }
 
-type AllocateService struct {
-	//用于存储创建好的MappedFile文件
-	requestMap map[string]*AllocateRequest
-	Pool       *ants.PoolWithFunc
+// Start 根据刷盘方式启动刷盘服务, 并启动过期文件的清理服务
+// 修改 Config 之后需要在 Start 之前完成, 启动时会根据配置重新创建写入锁
+func (this *MappedFileQueue) Start() {
+	this.putLock = NewPutLock(this.Config.PutLockType)
+
+	//同步刷盘需要写入的数据立即可以刷盘, 不能使用写入缓冲池
+	if this.Config.TransientStorePoolEnable {
+		if this.Config.FlushMode == AsyncFlush {
+			this.transientStorePool = NewTransientStorePool(this.Config.TransientStorePoolSize, this.FileSize)
+			this.transientStorePool.Init()
+		} else {
+			Logger.Warnf("MappedFileQueue %s 使用同步刷盘, 不启用写入缓冲池", this.FileDir)
+		}
+	}
+
+	allocateService := NewAllocateService(this.Config, this.Storage, this.transientStorePool)
+	if err := allocateService.Start(); err != nil {
+		Logger.Error("Start allocate service error: ", err)
+	} else {
+		this.allocateService = allocateService
+	}
+
+	if this.Config.FlushMode == SyncFlush {
+		this.flushService = NewGroupCommitService(this)
+	} else {
+		this.flushService = NewFlushRealTimeService(this, this.Config)
+	}
+	this.flushService.Start()
+
+	if this.transientStorePool != nil {
+		this.commitService = NewCommitRealTimeService(this, this.Config, this.flushService)
+		this.commitService.Start()
+	}
+
+	this.cleanService = NewCleanService(this, this.Config)
+	this.cleanService.Start()
 }
 
-func (service AllocateService) AddRequest(nextFile, nextNextFile string) (*MappedFile, error) {
-	if strings.TrimSpace(nextFile) == "" {
-		return nil, errors.New("nextFile name must not be null")
+// Shutdown 停止文件创建、刷盘与清理服务, 停止前会将所有数据刷盘, 最后关闭所有文件
+// 关闭之后仍然可以获取写入位置等信息, 但是不能再读取与写入
+func (this *MappedFileQueue) Shutdown() {
+	if this.allocateService != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), allocateWaitTimeout)
+		if err := this.allocateService.Shutdown(ctx); err != nil {
+			Logger.Error("Shutdown allocate service error: ", err)
+		}
+		cancel()
+		this.allocateService = nil
+	}
+
+	if this.cleanService != nil {
+		this.cleanService.Shutdown()
+		this.cleanService = nil
+	}
+
+	if this.commitService != nil {
+		this.commitService.Shutdown()
+		this.commitService = nil
+	}
+
+	if this.flushService != nil {
+		this.flushService.Shutdown()
+		this.flushService = nil
+	}
+
+	if this.checkpoint != nil {
+		flushAll(this)
+		this.checkpoint.MarkCleanShutdown()
+		if err := this.checkpoint.Close(); err != nil {
+			Logger.Error("Close checkpoint error: ", err)
+		}
+		this.checkpoint = nil
+	}
+
+	//关闭文件时提交写入缓冲区中剩余的数据并归还缓冲区, 需要在销毁缓冲池之前完成
+	for _, mappedFile := range this.getMappedFiles() {
+		if err := mappedFile.Close(); err != nil {
+			Logger.Errorf("关闭MappedFile %s 失败: %v", mappedFile.FileName, err)
+		}
+	}
+
+	if this.transientStorePool != nil {
+		this.transientStorePool.Destroy()
+		this.transientStorePool = nil
+	}
+}
+
+// AppendRecord 在队列末尾追加一条记录, 返回记录分配到的全局偏移量
+// 多个写入方可以并发调用, 当前文件剩余空间不足时切换到下一个文件, 同步刷盘时等待数据落盘后返回
+// 配置了压缩算法时记录内容按照配置压缩之后写入
+func (this *MappedFileQueue) AppendRecord(record *Record) (*AppendRecordResult, error) {
+	if err := record.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := this.compressRecord(record); err != nil {
+		return nil, err
 	}
-	if strings.TrimSpace(nextNextFile) == "" {
-		return nil, errors.New("nextNextFile name must not be null")
+
+	if this.isRecordTooLarge(int64(record.Size())) {
+		return nil, ErrRecordTooLarge
 	}
 
-	//判断数据是否已经存在
-	request, ok := service.requestMap[nextFile]
-	if !ok {
-		request = NewAllocateRequest(nextFile)
-		service.requestMap[nextFile] = request
-		//添加请求
-		_ = service.Pool.Invoke(request)
+	result, err := this.appendRecordLocked(record)
+	if err != nil {
+		return nil, err
 	}
 
-	//判断下下个文件是否也已经创建了
-	_, ok = service.requestMap[nextNextFile]
-	if !ok {
-		nextRequest := NewAllocateRequest(nextNextFile)
-		//添加请求
-		_ = service.Pool.Invoke(nextRequest)
+	return result, this.handleFlush(result)
+}
+
+// appendRecordLocked 在写入锁内分配写入位置并写入记录
+func (this *MappedFileQueue) appendRecordLocked(record *Record) (*AppendRecordResult, error) {
+	this.putLock.Lock()
+	defer this.putLock.Unlock()
+
+	mappedFile, err := this.GetLastMappedFile(true)
+	if err != nil {
+		return nil, err
 	}
 
-	statics.Logger.Info(nextFile)
-	statics.Logger.Info(nextNextFile)
+	result, err := mappedFile.AppendRecord(record)
+	if err == ErrInsufficientSpace {
+		//当前文件剩余空间不足, 已经写入文件结束标记, 在新文件中写入
+		if mappedFile, err = this.GetLastMappedFile(true); err != nil {
+			return nil, err
+		}
+		result, err = mappedFile.AppendRecord(record)
+	}
 
-	timer := time.NewTimer(time.Second * 5)
-	timeout := false
+	//使用写入缓冲区的文件在提交之后才能读取
+	if err == nil && mappedFile.transientStorePool == nil {
+		this.arriving.NotifyAll()
+	}
+	return result, err
+}
 
-	select {
-	//等待请求创建完成
-	case <-request.Done():
-	//超时时间为5s
-	case <-timer.C:
-		timeout = true
+// AppendBatch 将多条记录内容编码之后在一次加锁中写入队列末尾, 返回每条记录的全局偏移量
+// 每条记录保留完整的记录头, 读取方与逐条写入的记录一样读取; 同一个文件中的记录拼接之后一次拷贝, 剩余空间不足时切换到下一个文件
+// 同步刷盘时整批记录只提交一次刷盘请求; 切换文件失败时返回已经写入的记录的偏移量与错误
+func (this *MappedFileQueue) AppendBatch(records [][]byte) ([]int64, error) {
+	if len(records) == 0 {
+		return []int64{}, nil
 	}
 
-	if timeout {
-		return nil, errors.New("Get file timeout")
+	encoded := make([][]byte, 0, len(records))
+	for _, body := range records {
+		record := NewRecord(body)
+		if err := record.Validate(); err != nil {
+			return nil, err
+		}
+
+		if err := this.compressRecord(record); err != nil {
+			return nil, err
+		}
+
+		if this.isRecordTooLarge(int64(record.Size())) {
+			return nil, ErrRecordTooLarge
+		}
+		encoded = append(encoded, record.Encode())
 	}
 
-	result := service.requestMap[nextFile]
+	offsets, storeTimestamp, err := this.appendBatchLocked(encoded)
+	if len(offsets) == 0 {
+		return offsets, err
+	}
 
-	//删除数据
-	delete(service.requestMap, nextFile)
-	return result.mappedFile, nil
+	last := len(offsets) - 1
+	result := &AppendRecordResult{
+		WroteOffset:    offsets[last],
+		WroteBytes:     len(encoded[last]),
+		StoreTimestamp: storeTimestamp,
+	}
+	if flushErr := this.handleFlush(result); err == nil {
+		err = flushErr
+	}
+	return offsets, err
 }
 
-// Start 启动内部携程
-func (service *AllocateService) Start() {
-	handler := ants.WithPanicHandler(func(i interface{}) {
-		statics.Logger.Error(i)
+// appendBatchLocked 在写入锁内依次将记录写入最后一个文件, 当前文件写满之后切换到下一个文件
+// 写入时间在加锁之后设置, 保证 commit log 中记录的写入时间单调递增, 返回记录的写入时间
+func (this *MappedFileQueue) appendBatchLocked(encoded [][]byte) ([]int64, int64, error) {
+	this.putLock.Lock()
+	defer this.putLock.Unlock()
+
+	storeTimestamp := time.Now().UnixMilli()
+	for _, data := range encoded {
+		putStoreTimestamp(data, storeTimestamp)
+	}
+
+	offsets := make([]int64, 0, len(encoded))
+	notify := false
+	var err error
+	for len(offsets) < len(encoded) {
+		mappedFile, createErr := this.GetLastMappedFile(true)
+		if createErr != nil {
+			err = createErr
+			break
+		}
+
+		writePos, count, appendErr := mappedFile.appendRecords(encoded[len(offsets):], storeTimestamp)
+		if appendErr == ErrInsufficientSpace {
+			//当前文件已经写入文件结束标记, 在新文件中继续写入
+			continue
+		}
+
+		if appendErr != nil {
+			err = appendErr
+			break
+		}
+
+		offset := mappedFile.fileFromOffset + writePos
+		for _, data := range encoded[len(offsets) : len(offsets)+count] {
+			offsets = append(offsets, offset)
+			offset += int64(len(data))
+		}
+
+		//使用写入缓冲区的文件在提交之后才能读取
+		notify = notify || mappedFile.transientStorePool == nil
+	}
+
+	if notify {
+		this.arriving.NotifyAll()
+	}
+	return offsets, storeTimestamp, err
+}
+
+// isRecordTooLarge 长度为 size 的记录是否无法写入一个空文件
+// 与 MappedFile.AppendRecord 的规则一致: 记录恰好写满文件, 或者记录之后的剩余空间能够容纳文件结束标记
+func (this *MappedFileQueue) isRecordTooLarge(size int64) bool {
+	return size > this.FileSize || size != this.FileSize && size > this.FileSize-blankMarkerSize
+}
+
+// compressRecord 按照队列配置的压缩算法压缩记录内容
+func (this *MappedFileQueue) compressRecord(record *Record) error {
+	return record.Compress(this.Config.CompressionType, this.Config.CompressThreshold)
+}
+
+// handleFlush 同步刷盘时提交刷盘请求并等待, 异步刷盘时唤醒刷盘协程
+func (this *MappedFileQueue) handleFlush(result *AppendRecordResult) error {
+	switch service := this.flushService.(type) {
+	case *GroupCommitService:
+		request := NewGroupCommitRequest(result.WroteOffset + int64(result.WroteBytes))
+		service.PutRequest(request)
+		return request.Wait(this.Config.SyncFlushTimeout)
+	case *FlushRealTimeService:
+		//使用写入缓冲池时数据需要先提交才能刷盘
+		if this.commitService != nil {
+			this.commitService.Wakeup()
+		} else {
+			service.Wakeup()
+		}
+	}
+
+	return nil
+}
+
+// Flush 将 flushWhere 所在文件的脏页刷盘, 返回刷盘位置是否推进, 刷盘失败时返回false
+func (this *MappedFileQueue) Flush(flushLeastPages int) bool {
+	flushWhere := this.GetFlushedWhere()
+	mappedFile, err := this.FindMappedFileByOffset(flushWhere)
+	if errors.Is(err, ErrOffsetDeleted) {
+		mappedFile, err = this.getFirstFile(), nil
+	}
+
+	//flushWhere 位于文件末尾时需要检查文件是否还有未刷盘的数据
+	if errors.Is(err, ErrOffsetBeyondMax) {
+		mappedFile, err = this.getLastFile(), nil
+	}
+
+	if err != nil || mappedFile == nil || !mappedFile.IsAbleToFlush(flushLeastPages) {
+		return false
+	}
+
+	if err := mappedFile.Flush(); err != nil {
+		Logger.Errorf("MappedFile %s 刷盘失败: %v", mappedFile.FileName, err)
+		return false
+	}
+
+	//刷盘位置没有推进时返回false, 避免调用方在刷盘失败时不断重试
+	newFlushWhere := mappedFile.fileFromOffset + mappedFile.GetFlushPosition()
+	if newFlushWhere <= flushWhere {
+		return false
+	}
+	atomic.StoreInt64(&this.flushWhere, newFlushWhere)
+
+	if this.checkpoint != nil {
+		this.checkpoint.SetFlushedOffset(newFlushWhere)
+		this.checkpoint.Flush()
+	}
+	return true
+}
+
+// Commit 将 committedWhere 所在文件写入缓冲区中的数据提交到映射区域, 返回提交位置是否推进
+// 没有使用写入缓冲区的文件写入的数据可以直接读取, 提交位置直接推进到写入位置
+func (this *MappedFileQueue) Commit(commitLeastPages int) bool {
+	committedWhere := this.GetCommittedWhere()
+	mappedFile := this.findMappedFileForCommit(committedWhere)
+	if mappedFile == nil {
+		return false
+	}
+
+	mappedFile.Commit(commitLeastPages)
+	newCommittedWhere := mappedFile.fileFromOffset + mappedFile.GetReadPosition()
+	if newCommittedWhere <= committedWhere {
+		return false
+	}
+
+	atomic.StoreInt64(&this.committedWhere, newCommittedWhere)
+	this.arriving.NotifyAll()
+	return true
+}
+
+// WaitForOffset 阻塞直到可以读取的最大偏移量超过 offset, 即 offset 之后有新的数据写入并且可以读取
+// 不使用写入缓冲池时写入之后即可读取, 使用写入缓冲池时需要等待数据提交, ctx 结束时返回 ctx 的错误
+func (this *MappedFileQueue) WaitForOffset(ctx context.Context, offset int64) error {
+	for {
+		//先获取通知再检查, 避免检查之后写入的数据错过通知
+		arriving := this.arriving.Wait()
+		if this.GetMaxOffset() > offset {
+			return nil
+		}
+
+		select {
+		case <-arriving:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// findMappedFileForCommit 查找提交位置所在的文件, 提交位置位于文件末尾时返回下一个文件
+// 提交位置可能超过可读取的位置, 因此不能使用 FindMappedFileByOffset
+func (this *MappedFileQueue) findMappedFileForCommit(offset int64) *MappedFile {
+	mappedFiles := this.getMappedFiles()
+	if len(mappedFiles) == 0 {
+		return nil
+	}
+
+	firstFile := mappedFiles[0]
+	if offset < firstFile.fileFromOffset {
+		return firstFile
+	}
+
+	index := int((offset - firstFile.fileFromOffset) / this.FileSize)
+	if index >= len(mappedFiles) {
+		return nil
+	}
+	return mappedFiles[index]
+}
+
+// GetCommittedWhere 获取已经提交的全局偏移量
+func (this *MappedFileQueue) GetCommittedWhere() int64 {
+	return atomic.LoadInt64(&this.committedWhere)
+}
+
+// GetFlushedWhere 获取已经刷盘的全局偏移量
+func (this *MappedFileQueue) GetFlushedWhere() int64 {
+	return atomic.LoadInt64(&this.flushWhere)
+}
+
+// Load 加载目录下已经存在的 MappedFile 文件与检查点
+// 加载后的文件全部视为已写满, 需要调用 Recover 找到真实的写入位置
+func (this *MappedFileQueue) Load() error {
+	if err := this.Storage.MkdirAll(this.FileDir); err != nil {
+		return err
+	}
+
+	checkpoint, err := NewCheckpoint(this.Storage, filepath.Join(this.FileDir, checkpointFileName))
+	if err != nil {
+		return err
+	}
+	this.checkpoint = checkpoint
+
+	entries, err := this.Storage.ReadDir(this.FileDir)
+	if err != nil {
+		return err
+	}
+
+	fileNames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !mappedFileNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		fileNames = append(fileNames, entry.Name())
+	}
+
+	//文件名长度固定, 按照字符串排序即为按照偏移量排序
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		mappedFile, err := NewMappedFileWithStorage(this.Storage, filepath.Join(this.FileDir, fileName), this.FileSize, false)
+		if err != nil {
+			return err
+		}
+
+		//文件之间的偏移量必须是连续的
+		if lastFile := this.getLastFile(); lastFile != nil && lastFile.fileFromOffset+this.FileSize != mappedFile.fileFromOffset {
+			_ = mappedFile.Close()
+			return fmt.Errorf("mapped file %s is not continuous with %s", mappedFile.FileName, lastFile.FileName)
+		}
+
+		mappedFile.SetWritePosition(this.FileSize)
+		mappedFile.SetFlushPosition(this.FileSize)
+		this.filesLock.Lock()
+		this.mappedFiles = append(this.mappedFiles, mappedFile)
+		this.filesLock.Unlock()
+		Logger.Infof("加载MappedFile: %s", mappedFile.FileName)
+	}
+
+	return nil
+}
+
+// Recover 从第一个文件开始逐条校验记录, 找到最后一条完整记录的结束位置
+// 后续的写入将从该位置继续, 之后的残缺数据与文件都会被截断
+func (this *MappedFileQueue) Recover() {
+	mappedFiles := this.getMappedFiles()
+	startIndex := this.recoverStartIndex()
+
+	var processOffset int64 = 0
+	if startIndex > 0 {
+		processOffset = mappedFiles[startIndex].fileFromOffset
+	}
+
+	for _, mappedFile := range mappedFiles[startIndex:] {
+		validLength := mappedFile.recoverValidLength()
+		processOffset = mappedFile.fileFromOffset + validLength
+		if validLength < this.FileSize {
+			break
+		}
+	}
+
+	this.truncateTo(processOffset)
+	Logger.Infof("恢复MappedFileQueue完成, 写入位置: %d", processOffset)
+}
+
+// truncateTo 将队列的写入位置重置到 offset, offset 之后的数据与文件都会被截断
+func (this *MappedFileQueue) truncateTo(offset int64) {
+	atomic.StoreInt64(&this.flushWhere, offset)
+	atomic.StoreInt64(&this.committedWhere, offset)
+	this.truncateDirtyFiles(offset)
+
+	if this.checkpoint != nil {
+		this.checkpoint.SetFlushedOffset(offset)
+		this.checkpoint.MarkRunning()
+	}
+}
+
+// recoverStartIndex 根据检查点确定开始校验的文件
+// 检查点记录的刷盘位置之前的数据已经落盘, 只需要从刷盘位置所在的文件开始校验
+func (this *MappedFileQueue) recoverStartIndex() int {
+	if this.checkpoint == nil || this.checkpoint.IsCreated() {
+		return 0
+	}
+
+	this.abnormalShutdown = !this.checkpoint.IsCleanShutdown()
+	if this.abnormalShutdown {
+		Logger.Warnf("MappedFileQueue %s 上一次没有正常关闭", this.FileDir)
+	}
+
+	flushedOffset := this.checkpoint.GetFlushedOffset()
+	mappedFiles := this.getMappedFiles()
+	for i := len(mappedFiles) - 1; i >= 0; i-- {
+		mappedFile := mappedFiles[i]
+		if mappedFile.fileFromOffset <= flushedOffset && flushedOffset <= mappedFile.fileFromOffset+this.FileSize {
+			Logger.Infof("从检查点恢复, 刷盘位置: %d, 开始校验文件: %s", flushedOffset, mappedFile.FileName)
+			return i
+		}
+	}
+
+	//检查点与文件不一致时从第一个文件开始校验
+	Logger.Warnf("检查点刷盘位置 %d 不在任何文件中, 从第一个文件开始校验", flushedOffset)
+	return 0
+}
+
+// IsAbnormalShutdown 上一次运行是否异常退出, 需要在 Recover 之后调用
+func (this *MappedFileQueue) IsAbnormalShutdown() bool {
+	return this.abnormalShutdown
+}
+
+// truncateDirtyFiles 重置包含 offset 的文件的写入位置, 并删除 offset 之后的文件
+func (this *MappedFileQueue) truncateDirtyFiles(offset int64) {
+	mappedFiles := this.getMappedFiles()
+	retained := make([]*MappedFile, 0, len(mappedFiles))
+	for _, mappedFile := range mappedFiles {
+		fileTailOffset := mappedFile.fileFromOffset + this.FileSize
+		if fileTailOffset <= offset {
+			retained = append(retained, mappedFile)
+			continue
+		}
+
+		if mappedFile.fileFromOffset <= offset {
+			position := offset % this.FileSize
+			mappedFile.SetWritePosition(position)
+			mappedFile.SetFlushPosition(position)
+			retained = append(retained, mappedFile)
+			continue
+		}
+
+		if err := mappedFile.Destroy(0); err != nil {
+			Logger.Error("Destroy dirty MappedFile error: ", err)
+		}
+	}
+
+	this.filesLock.Lock()
+	this.mappedFiles = retained
+	this.filesLock.Unlock()
+}
+
+// GetMaxOffset 获取队列当前可以读取的最大偏移量, 使用写入缓冲池时为提交的位置
+func (this *MappedFileQueue) GetMaxOffset() int64 {
+	fileLast := this.getLastFile()
+	if fileLast == nil {
+		return 0
+	}
+
+	return fileLast.fileFromOffset + fileLast.GetReadPosition()
+}
+
+// GetMaxWrotePosition 获取队列当前的最大写入偏移量, 包含写入缓冲区中尚未提交的数据
+func (this *MappedFileQueue) GetMaxWrotePosition() int64 {
+	fileLast := this.getLastFile()
+	if fileLast == nil {
+		return 0
+	}
+
+	return fileLast.fileFromOffset + fileLast.GetWritePosition()
+}
+
+// DeleteExpiredFiles 按照从旧到新的顺序删除过期的文件, 返回删除的文件数量
+// 最后一个文件与未完全刷盘的文件不会被删除, 遇到这些文件时停止删除
+// 仍被读取方持有的文件会先关闭, 等待引用全部释放或者超过 intervalForcibly 之后在下一次清理时删除
+// cleanImmediately 为true时不考虑文件的保留时间
+func (this *MappedFileQueue) DeleteExpiredFiles(reservedTime time.Duration, intervalForcibly time.Duration, cleanImmediately bool, batchMax int) int {
+	mappedFiles := this.getMappedFiles()
+	now := time.Now().UnixMilli()
+	flushWhere := this.GetFlushedWhere()
+
+	deleteCount := 0
+	for i, mappedFile := range mappedFiles {
+		if i == len(mappedFiles)-1 || deleteCount >= batchMax {
+			break
+		}
+
+		expired := now-mappedFile.GetLastModifiedTimestamp() >= reservedTime.Milliseconds()
+		if !expired && !cleanImmediately {
+			break
+		}
+
+		if mappedFile.fileFromOffset+this.FileSize > flushWhere {
+			break
+		}
+
+		err := mappedFile.Destroy(intervalForcibly)
+		if errors.Is(err, ErrMappedFileInUse) {
+			Logger.Warnf("MappedFile %s 正在被读取, 暂不删除", mappedFile.FileName)
+			break
+		}
+
+		if err != nil {
+			Logger.Error("Destroy expired MappedFile error: ", err)
+		}
+		deleteCount++
+	}
+
+	if deleteCount == 0 {
+		return 0
+	}
+
+	this.filesLock.Lock()
+	this.mappedFiles = this.mappedFiles[deleteCount:]
+	this.filesLock.Unlock()
+	return deleteCount
+}
+
+// GetTotalFileSize 所有文件占用的磁盘空间
+func (this *MappedFileQueue) GetTotalFileSize() int64 {
+	return int64(len(this.getMappedFiles())) * this.FileSize
+}
+
+// GetMinOffset 获取队列当前的最小偏移量
+func (this *MappedFileQueue) GetMinOffset() int64 {
+	firstFile := this.getFirstFile()
+	if firstFile == nil {
+		return 0
+	}
+
+	return firstFile.fileFromOffset
+}
+
+// ReadAt 从全局偏移量 offset 开始读取 n 个字节, 数据跨越多个文件时会依次读取
+func (this *MappedFileQueue) ReadAt(offset int64, n int) ([]byte, error) {
+	if offset < this.GetMinOffset() {
+		return nil, this.newOffsetError(offset, ErrOffsetDeleted)
+	}
+
+	if offset+int64(n) > this.GetMaxOffset() {
+		return nil, this.newOffsetError(offset, ErrOffsetBeyondMax)
+	}
+
+	result := make([]byte, 0, n)
+	for len(result) < n {
+		mappedFile, err := this.FindMappedFileByOffset(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		data := mappedFile.ReadBytes(offset-mappedFile.fileFromOffset, n-len(result))
+		if len(data) == 0 {
+			return nil, ErrOffsetOutOfRange
+		}
+
+		result = append(result, data...)
+		offset += int64(len(data))
+	}
+
+	return result, nil
+}
+
+// ReadRecord 读取全局偏移量 offset 位置的记录, offset 必须是一条记录的起始位置
+// 记录内容直接引用映射区域, 使用完成后需要调用 Record.Release
+func (this *MappedFileQueue) ReadRecord(offset int64) (*Record, error) {
+	mappedFile, err := this.FindMappedFileByOffset(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := mappedFile.ReadRecord(offset - mappedFile.fileFromOffset)
+	if errors.Is(err, ErrMappedFileUnavailable) {
+		return nil, this.newOffsetError(offset, ErrOffsetDeleted)
+	}
+	return record, err
+}
+
+// Iterator 创建从全局偏移量 offset 开始的记录迭代器, offset 必须是一条记录的起始位置
+func (this *MappedFileQueue) Iterator(offset int64) *Iterator {
+	return &Iterator{
+		queue:      this,
+		nextOffset: offset,
+	}
+}
+
+// IteratorFromTimestamp 创建从第一条写入时间不早于 timestamp 的记录开始的迭代器
+func (this *MappedFileQueue) IteratorFromTimestamp(timestamp int64) (*Iterator, error) {
+	offset, err := this.OffsetForTimestamp(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.Iterator(offset), nil
+}
+
+// OffsetForTimestamp 查找第一条写入时间不早于 timestamp 的记录的全局偏移量, 所有记录都早于 timestamp 时返回最大偏移量
+// 记录的写入时间是递增的, 先根据每个文件第一条记录的写入时间二分查找到所在的文件, 再在文件内顺序查找
+func (this *MappedFileQueue) OffsetForTimestamp(timestamp int64) (int64, error) {
+	mappedFiles := this.getMappedFiles()
+	if len(mappedFiles) == 0 {
+		return 0, nil
+	}
+
+	//第一个第一条记录不早于 timestamp 的文件, 没有记录的文件视为晚于所有记录
+	var searchErr error
+	index := sort.Search(len(mappedFiles), func(i int) bool {
+		firstTimestamp, err := mappedFiles[i].GetFirstTimestamp()
+		if err != nil && err != ErrNoMoreRecord && searchErr == nil {
+			searchErr = err
+		}
+		return err != nil || firstTimestamp >= timestamp
 	})
-	service.requestMap = make(map[string]*AllocateRequest)
-	service.Pool, _ = ants.NewPoolWithFunc(poolSize, service.createFile, handler)
+	if searchErr != nil {
+		return 0, searchErr
+	}
+
+	if index == 0 {
+		return mappedFiles[0].fileFromOffset, nil
+	}
+
+	//前一个文件的最后一条记录早于 timestamp 时, 目标记录是当前文件的第一条记录
+	lastTimestamp, err := mappedFiles[index-1].GetLastTimestamp()
+	if err != nil && err != ErrNoMoreRecord {
+		return 0, err
+	}
+	if err == nil && lastTimestamp < timestamp {
+		if index < len(mappedFiles) {
+			return mappedFiles[index].fileFromOffset, nil
+		}
+		return this.GetMaxOffset(), nil
+	}
+
+	//目标记录位于前一个文件中
+	it := this.Iterator(mappedFiles[index-1].fileFromOffset)
+	defer it.Close()
+
+	for it.Next() {
+		if it.Record().StoreTimestamp >= timestamp {
+			return it.Offset(), nil
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return it.NextOffset(), nil
 }
 
-// createFile 创建文件的流程
-func (service *AllocateService) createFile(data interface{}) {
-	request := data.(*AllocateRequest)
-	fileName := request.FileName
-	statics.Logger.Infof("接收到创建请求: %s", request)
-	mappedFile := NewMappedFile(fileName, fileSize, false)
-	request.mappedFile = mappedFile
-	//创建完成后不在阻塞创建线程
-	request.Stop()
+// FindMappedFileByOffset 查找包含全局偏移量 offset 的文件
+// 优先判断第一个与最后一个文件, 其余情况按照文件起始偏移量二分查找
+func (this *MappedFileQueue) FindMappedFileByOffset(offset int64) (*MappedFile, error) {
+	mappedFiles := this.getMappedFiles()
+	if len(mappedFiles) == 0 {
+		return nil, this.newOffsetError(offset, ErrOffsetBeyondMax)
+	}
+
+	firstFile, lastFile := mappedFiles[0], mappedFiles[len(mappedFiles)-1]
+
+	if offset < firstFile.fileFromOffset {
+		return nil, this.newOffsetError(offset, ErrOffsetDeleted)
+	}
+
+	if offset >= lastFile.fileFromOffset+lastFile.GetReadPosition() {
+		return nil, this.newOffsetError(offset, ErrOffsetBeyondMax)
+	}
+
+	if offset < firstFile.fileFromOffset+this.FileSize {
+		return firstFile, nil
+	}
+
+	if offset >= lastFile.fileFromOffset {
+		return lastFile, nil
+	}
+
+	index := sort.Search(len(mappedFiles), func(i int) bool {
+		return mappedFiles[i].fileFromOffset+this.FileSize > offset
+	})
+	return mappedFiles[index], nil
 }
 
-type MappedFileQueue struct {
-	//文件目录
-	FileDir string
-	//目录下的所有mmapFile文件
-	mappedFiles []*MappedFile
-	//flush的位置，对于所有的文件而言
-	flushWhere int64
-	//每个文件的大小
-	FileSize int64
+func (this *MappedFileQueue) newOffsetError(offset int64, err error) error {
+	return &OffsetError{
+		Offset:    offset,
+		MinOffset: this.GetMinOffset(),
+		MaxOffset: this.GetMaxOffset(),
+		Err:       err,
+	}
 }
 
 // GetLastMappedFile :获取最后一个文件
-// needCreate: 当没有文件时是否需要创建
-func (this *MappedFileQueue) GetLastMappedFile(needCreate bool) *MappedFile {
+// needCreate: 当没有文件或者最后一个文件已经写满时是否需要创建, 创建失败时返回创建文件的错误
+func (this *MappedFileQueue) GetLastMappedFile(needCreate bool) (*MappedFile, error) {
 
 	var createOffset int64 = -1
 	fileLast := this.getLastFile()
@@ -140,35 +870,73 @@ func (this *MappedFileQueue) GetLastMappedFile(needCreate bool) *MappedFile {
 	}
 
 	if createOffset != -1 && needCreate {
-		fileName := fmt.Sprintf("%020d", createOffset)
-		nextFileName := fmt.Sprintf("%020d", createOffset+this.FileSize)
-
 		//拼接下一个文件的的路径
-		nextFile := filepath.Join(this.FileDir, fileName)
-		nextNextFile := filepath.Join(this.FileDir, nextFileName)
+		nextFile := this.mappedFileName(createOffset)
 
-		mappedFile, err := allocateService.AddRequest(nextFile, nextNextFile)
+		var mappedFile *MappedFile
+		var err error
+		if this.allocateService != nil {
+			//预先创建之后的文件, 下一次切换文件时可以直接使用
+			preAllocateFiles := make([]string, 0, this.Config.PreAllocateCount)
+			for i := 1; i <= this.Config.PreAllocateCount; i++ {
+				preAllocateFiles = append(preAllocateFiles, this.mappedFileName(createOffset+int64(i)*this.FileSize))
+			}
+			mappedFile, err = this.allocateService.AddRequest(nextFile, this.FileSize, preAllocateFiles...)
+		} else {
+			mappedFile, err = NewTransientMappedFile(this.Storage, nextFile, this.FileSize, this.transientStorePool)
+		}
 		if err != nil {
-			statics.Logger.Error("Create MappedFile error: ", err)
+			Logger.Error("Create MappedFile error: ", err)
+			return nil, err
 		}
 
+		this.filesLock.Lock()
 		this.mappedFiles = append(this.mappedFiles, mappedFile)
-		return mappedFile
+		this.filesLock.Unlock()
+		return mappedFile, nil
 	}
 
-	return fileLast
+	return fileLast, nil
 }
 
-// getLastFile 获取最新的 MappedFile 文件
-func (this MappedFileQueue) getLastFile() *MappedFile {
-	fileCount := len(this.mappedFiles)
-	if fileCount > 0 {
-		return this.mappedFiles[fileCount-1]
+// mappedFileName 起始偏移量为 offset 的文件路径
+func (this *MappedFileQueue) mappedFileName(offset int64) string {
+	return filepath.Join(this.FileDir, fmt.Sprintf("%020d", offset))
+}
+
+// GetAllocateMetrics 获取文件创建的统计信息, 没有启动文件创建服务时返回空的统计信息
+func (this *MappedFileQueue) GetAllocateMetrics() AllocateMetrics {
+	if this.allocateService == nil {
+		return AllocateMetrics{}
+	}
+
+	return this.allocateService.Metrics()
+}
+
+// getMappedFiles 获取当前所有的文件
+func (this *MappedFileQueue) getMappedFiles() []*MappedFile {
+	this.filesLock.RLock()
+	defer this.filesLock.RUnlock()
+	return this.mappedFiles
+}
+
+// getFirstFile 获取最早的 MappedFile 文件
+func (this *MappedFileQueue) getFirstFile() *MappedFile {
+	mappedFiles := this.getMappedFiles()
+	if len(mappedFiles) > 0 {
+		return mappedFiles[0]
 	}
 
 	return nil
 }
 
-func init() {
-	allocateService.Start()
+// getLastFile 获取最新的 MappedFile 文件
+func (this *MappedFileQueue) getLastFile() *MappedFile {
+	mappedFiles := this.getMappedFiles()
+	fileCount := len(mappedFiles)
+	if fileCount > 0 {
+		return mappedFiles[fileCount-1]
+	}
+
+	return nil
 }
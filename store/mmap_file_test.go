@@ -1,16 +1,26 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/spf13/afero"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestNewMmapFile(t *testing.T) {
-	mmapFile := NewMappedFile("test.txt", fileSize, false)
-	mmapFile.Write([]byte("1234==========================================="))
+	mmapFile, err := NewMappedFile(filepath.Join(t.TempDir(), fmt.Sprintf("%020d", 0)), fileSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mmapFile.Append([]byte("1234==========================================="))
 	mmapFile.Flush()
-
-	fmt.Printf("%s", mmapFile.mmapRegion)
+	_ = mmapFile.Close()
 }
 
 func TestFormmater(t *testing.T) {
@@ -19,12 +29,431 @@ func TestFormmater(t *testing.T) {
 }
 
 func TestGetLastFile(t *testing.T) {
-	queue := MappedFileQueue{
-		FileSize: fileSize,
-		FileDir:  "D:\\go-project\\turing\\store",
+	queue := NewMappedFileQueue(t.TempDir(), fileSize)
+
+	mappedFile := lastMappedFile(t, queue)
+	mappedFile.Append([]byte("12345"))
+	_ = mappedFile.Close()
+}
+
+func TestRecoverMappedFileQueue(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewMappedFileQueue(dir, fileSize)
+
+	mappedFile := lastMappedFile(t, queue)
+	first, err := mappedFile.AppendRecord(NewRecord([]byte("12345")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := mappedFile.AppendRecord(NewRecord([]byte("67890")))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	mappedFile := queue.GetLastMappedFile(true)
-	mappedFile.Write([]byte("12345"))
+	//模拟第二条记录写入了一半
+	region := mappedFile.region.Bytes()
+	region[second.WroteOffset+int64(second.WroteBytes)-1] = 0
+	mappedFile.Flush()
 	_ = mappedFile.Close()
+
+	reopened := NewMappedFileQueue(dir, fileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+
+	expectOffset := first.WroteOffset + int64(first.WroteBytes)
+	if maxOffset := reopened.GetMaxOffset(); maxOffset != expectOffset {
+		t.Fatalf("expect max offset %d, got %d", expectOffset, maxOffset)
+	}
+
+	//预创建的下一个文件没有数据, 恢复时需要被删除
+	if fileCount := len(reopened.mappedFiles); fileCount != 1 {
+		t.Fatalf("expect 1 mapped file, got %d", fileCount)
+	}
+
+	record, err := reopened.getLastFile().ReadRecord(first.WroteOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer record.Release()
+	if string(record.Body) != "12345" {
+		t.Fatalf("unexpected record body %s", record.Body)
+	}
+}
+
+func TestShutdownClosesMappedFiles(t *testing.T) {
+	queue := newTestQueue(t, 4)
+	if err := queue.Load(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Recover()
+	queue.Start()
+
+	for i := 0; i < 10; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	maxOffset := queue.GetMaxOffset()
+	queue.Shutdown()
+
+	//关闭之后所有文件都已经解除映射, 写入位置仍然可以获取
+	for _, mappedFile := range queue.getMappedFiles() {
+		if !mappedFile.IsCleanupOver() {
+			t.Fatalf("expect %s to be unmapped after shutdown", mappedFile.FileName)
+		}
+	}
+
+	if queue.GetMaxOffset() != maxOffset {
+		t.Fatalf("expect max offset %d after shutdown, got %d", maxOffset, queue.GetMaxOffset())
+	}
+
+	if _, err := queue.ReadRecord(0); err == nil {
+		t.Fatal("expect read after shutdown to fail")
+	}
+}
+
+func TestFindMappedFileByOffset(t *testing.T) {
+	queue := newTestQueue(t, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := lastMappedFile(t, queue).AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		offset := int64(i)*queue.FileSize + 1
+		mappedFile, err := queue.FindMappedFileByOffset(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mappedFile != queue.mappedFiles[i] {
+			t.Fatalf("offset %d found wrong file %s", offset, mappedFile.FileName)
+		}
+	}
+
+	_, err := queue.FindMappedFileByOffset(queue.GetMaxOffset())
+	if !errors.Is(err, ErrOffsetBeyondMax) || !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Fatalf("expect offset beyond max, got %v", err)
+	}
+
+	queue.mappedFiles = queue.mappedFiles[2:]
+	_, err = queue.FindMappedFileByOffset(queue.FileSize)
+	var offsetErr *OffsetError
+	if !errors.As(err, &offsetErr) || offsetErr.Err != ErrOffsetDeleted || offsetErr.MinOffset != 2*queue.FileSize {
+		t.Fatalf("expect offset deleted, got %v", err)
+	}
+}
+
+func TestRollWithBlankMarker(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewMappedFileQueue(dir, 1000)
+	for i := 0; i < 20; i++ {
+		result, err := queue.AppendRecord(NewRecord(testBody(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.WroteOffset%queue.FileSize+int64(result.WroteBytes) > queue.FileSize {
+			t.Fatalf("record %d crosses the end of mapped file", i)
+		}
+	}
+
+	firstFile := queue.mappedFiles[0]
+	if !firstFile.IsFull() {
+		t.Fatal("expect first file to be full")
+	}
+	if _, err := firstFile.ReadRecord(7 * int64(recordHeaderSize+100)); err != ErrEndOfFile {
+		t.Fatalf("expect end of file marker, got %v", err)
+	}
+	flushAll(queue)
+
+	reopened := NewMappedFileQueue(dir, queue.FileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+
+	if reopened.GetMaxOffset() != queue.GetMaxOffset() {
+		t.Fatalf("expect max offset %d, got %d", queue.GetMaxOffset(), reopened.GetMaxOffset())
+	}
+
+	count := 0
+	it := reopened.Iterator(0)
+	defer it.Close()
+	for it.Next() {
+		count++
+	}
+	if count != 20 {
+		t.Fatalf("expect 20 records, got %d", count)
+	}
+}
+
+func TestRecordSizeBoundary(t *testing.T) {
+	queue := newTestQueue(t, 4)
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	//记录之后的剩余空间不足以写入文件结束标记, 任何文件都无法写入
+	for size := queue.FileSize - blankMarkerSize + 1; size < queue.FileSize; size++ {
+		body := make([]byte, size-recordHeaderSize)
+		if _, err := queue.AppendRecord(NewRecord(body)); err != ErrRecordTooLarge {
+			t.Fatalf("expect record of size %d too large, got %v", size, err)
+		}
+
+		if _, err := queue.AppendBatch([][]byte{body}); err != ErrRecordTooLarge {
+			t.Fatalf("expect batch record of size %d too large, got %v", size, err)
+		}
+	}
+
+	if len(queue.mappedFiles) != 1 || queue.mappedFiles[0].IsFull() {
+		t.Fatalf("expect rejected records not to roll mapped files, got %d files", len(queue.mappedFiles))
+	}
+
+	//恰好写满文件以及之后能够容纳文件结束标记的记录可以写入新的文件
+	for _, size := range []int64{queue.FileSize, queue.FileSize - blankMarkerSize} {
+		result, err := queue.AppendRecord(NewRecord(make([]byte, size-recordHeaderSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.WroteOffset%queue.FileSize != 0 || int64(result.WroteBytes) != size {
+			t.Fatalf("expect record of size %d at the start of a new file, got offset %d", size, result.WroteOffset)
+		}
+	}
+
+	if len(queue.mappedFiles) != 3 {
+		t.Fatalf("expect 3 mapped files, got %d", len(queue.mappedFiles))
+	}
+
+	//绕过长度检查时空文件也放不下的记录返回错误, 只创建一个新的文件, 不会不断切换文件
+	tooLarge := NewRecord(make([]byte, queue.FileSize-blankMarkerSize+1-recordHeaderSize)).Encode()
+	if offsets, _, err := queue.appendBatchLocked([][]byte{tooLarge}); err != ErrRecordTooLarge || len(offsets) != 0 {
+		t.Fatalf("expect record too large, got %d offsets, %v", len(offsets), err)
+	}
+
+	if len(queue.mappedFiles) != 4 || queue.mappedFiles[3].GetWritePosition() != 0 {
+		t.Fatalf("expect one empty new mapped file, got %d files", len(queue.mappedFiles))
+	}
+}
+
+func TestAppendRecordValidate(t *testing.T) {
+	queue := newTestQueue(t, 4)
+
+	//topic 的长度超过记录头能够表示的范围
+	record := NewRecord(testBody(0))
+	record.Topic = strings.Repeat("t", maxTopicLength+1)
+	if _, err := queue.AppendRecord(record); err != ErrTopicTooLong {
+		t.Fatalf("expect topic too long, got %v", err)
+	}
+
+	record = NewRecord(testBody(0))
+	record.PutProperty("key", strings.Repeat("v", maxPropertiesLength))
+	if _, err := queue.AppendRecord(record); err != ErrPropertiesTooLong {
+		t.Fatalf("expect properties too long, got %v", err)
+	}
+
+	if queue.GetMaxOffset() != 0 {
+		t.Fatalf("expect rejected records not written, got max offset %d", queue.GetMaxOffset())
+	}
+}
+
+func TestAppendBatch(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewMappedFileQueue(dir, 1000)
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	//一批记录跨越三个文件
+	records := make([][]byte, 0, 15)
+	for i := 1; i <= 15; i++ {
+		records = append(records, testBody(i))
+	}
+	offsets, err := queue.AppendBatch(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(offsets) != 15 || len(queue.mappedFiles) != 3 {
+		t.Fatalf("expect 15 offsets in 3 files, got %d offsets in %d files", len(offsets), len(queue.mappedFiles))
+	}
+
+	for i, offset := range offsets {
+		if offset%queue.FileSize+int64(recordHeaderSize+100) > queue.FileSize {
+			t.Fatalf("record %d crosses the end of mapped file", i)
+		}
+
+		record, err := queue.ReadRecord(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(record.Body) != string(testBody(i+1)) {
+			t.Fatalf("unexpected record %d at %d", i, offset)
+		}
+		record.Release()
+	}
+
+	if _, err := queue.AppendBatch([][]byte{testBody(0), make([]byte, 1000)}); err != ErrRecordTooLarge {
+		t.Fatalf("expect record too large, got %v", err)
+	}
+	flushAll(queue)
+
+	//重新加载之后与逐条写入的记录一样可以恢复
+	reopened := NewMappedFileQueue(dir, queue.FileSize)
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Recover()
+
+	if reopened.GetMaxOffset() != queue.GetMaxOffset() {
+		t.Fatalf("expect max offset %d, got %d", queue.GetMaxOffset(), reopened.GetMaxOffset())
+	}
+
+	count := 0
+	it := reopened.Iterator(0)
+	defer it.Close()
+	for it.Next() {
+		count++
+	}
+	if count != 16 {
+		t.Fatalf("expect 16 records, got %d", count)
+	}
+}
+
+func TestAppendBatchTimestampOrder(t *testing.T) {
+	queue := newTestQueue(t, 64)
+
+	//并发写入的批量记录, 写入时间按照在 commit log 中的顺序单调递增
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := queue.AppendBatch([][]byte{testBody(i), testBody(j), testBody(i + j)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+
+	count := 0
+	var lastTimestamp int64
+	it := queue.Iterator(0)
+	defer it.Close()
+	for it.Next() {
+		if it.Record().StoreTimestamp < lastTimestamp {
+			t.Fatalf("record at %d stored at %d before previous record at %d", it.Offset(), it.Record().StoreTimestamp, lastTimestamp)
+		}
+		lastTimestamp = it.Record().StoreTimestamp
+		count++
+	}
+
+	if count != 8*50*3 {
+		t.Fatalf("expect %d records, got %d", 8*50*3, count)
+	}
+}
+
+func TestWaitForOffset(t *testing.T) {
+	queue := newTestQueue(t, 4)
+
+	result, err := queue.AppendRecord(NewRecord(testBody(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//已经可以读取的数据直接返回
+	if err := queue.WaitForOffset(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	maxOffset := queue.GetMaxOffset()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := queue.WaitForOffset(ctx, maxOffset); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- queue.WaitForOffset(context.Background(), result.WroteOffset+int64(result.WroteBytes))
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := queue.AppendRecord(NewRecord(testBody(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for offset not notified after append")
+	}
+}
+
+func TestWaitForOffsetWithTransientStorePool(t *testing.T) {
+	queue := newTestQueue(t, 4)
+	queue.Config.TransientStorePoolEnable = true
+	queue.Config.CommitInterval = time.Hour
+	queue.Config.CommitThoroughInterval = time.Hour
+	queue.Start()
+	defer queue.Shutdown()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- queue.WaitForOffset(context.Background(), 0)
+	}()
+
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	//使用写入缓冲池时提交之后才会唤醒
+	commitAll(queue)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for offset not notified after commit")
+	}
+
+	if queue.GetMaxOffset() == 0 {
+		t.Fatal("expect committed data readable")
+	}
+}
+
+// fullStorage 模拟磁盘空间不足, 无法创建新的文件
+type fullStorage struct {
+	*HeapStorage
+}
+
+func (storage *fullStorage) OpenRegion(fileName string, size int64, deleteIfExists bool) (Region, error) {
+	return nil, syscall.ENOSPC
+}
+
+func TestAppendCreateFileError(t *testing.T) {
+	queue := newTestQueue(t, 4)
+	queue.Storage = &fullStorage{HeapStorage: NewHeapStorage(afero.NewMemMapFs())}
+
+	//创建文件失败的原因返回给调用方
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expect no space error, got %v", err)
+	}
+
+	if _, err := queue.AppendBatch([][]byte{testBody(0)}); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expect no space error, got %v", err)
+	}
+
+	if mappedFile, err := queue.GetLastMappedFile(false); mappedFile != nil || err != nil {
+		t.Fatalf("expect no mapped file, got %v", err)
+	}
 }
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// PutLockType 写入锁的类型
+type PutLockType int
+
+const (
+	//MutexPutLock 互斥锁, 写入方较多或者写入耗时较长时使用
+	MutexPutLock PutLockType = iota
+
+	//SpinPutLock 自旋锁, 写入耗时很短时可以避免协程挂起的开销
+	SpinPutLock
+)
+
+// PutLock 写入锁, 保证同一时刻只有一个写入方在分配写入位置
+type PutLock interface {
+	Lock()
+
+	Unlock()
+}
+
+// NewPutLock 根据类型创建写入锁
+func NewPutLock(lockType PutLockType) PutLock {
+	if lockType == SpinPutLock {
+		return &SpinLock{}
+	}
+
+	return &sync.Mutex{}
+}
+
+// SpinLock 基于CAS的自旋锁
+type SpinLock struct {
+	locked int32
+}
+
+func (lock *SpinLock) Lock() {
+	for !atomic.CompareAndSwapInt32(&lock.locked, 0, 1) {
+		runtime.Gosched()
+	}
+}
+
+func (lock *SpinLock) Unlock() {
+	atomic.StoreInt32(&lock.locked, 0)
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentAppendRecord(t *testing.T) {
+	for _, lockType := range []PutLockType{MutexPutLock, SpinPutLock} {
+		queue := NewMappedFileQueue(t.TempDir(), 1000)
+		queue.Config.PutLockType = lockType
+		queue.Start()
+
+		offsets := sync.Map{}
+		waitGroup := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			waitGroup.Add(1)
+			go func(i int) {
+				defer waitGroup.Done()
+				for j := 0; j < 50; j++ {
+					result, err := queue.AppendRecord(NewRecord(testBody(i*50 + j)))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if _, loaded := offsets.LoadOrStore(result.WroteOffset, true); loaded {
+						t.Errorf("offset %d assigned twice", result.WroteOffset)
+					}
+				}
+			}(i)
+		}
+		waitGroup.Wait()
+
+		bodies := make(map[string]bool)
+		it := queue.Iterator(0)
+		for it.Next() {
+			bodies[string(it.Record().Body)] = true
+		}
+		it.Close()
+		queue.Shutdown()
+
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if len(bodies) != 400 {
+			t.Fatalf("expect 400 records, got %d", len(bodies))
+		}
+	}
+}
+
+func TestAppendRecordTooLarge(t *testing.T) {
+	queue := NewMappedFileQueue(t.TempDir(), 100)
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); err != ErrRecordTooLarge {
+		t.Fatalf("expect record too large, got %v", err)
+	}
+}
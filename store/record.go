@@ -0,0 +1,408 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//MagicCode 标识一条完整的记录
+	MagicCode int32 = -626843481
+
+	//BlankMagicCode 标识文件结束标记, 文件剩余空间不足以写入记录时在末尾写入
+	BlankMagicCode int32 = -875286124
+
+	//blankMarkerSize 文件结束标记的长度: totalSize(4) + magicCode(4)
+	blankMarkerSize = 4 + 4
+
+	//recordHeaderSize 记录头长度: totalSize(4) + magicCode(4) + bodyCRC(4) + queueOffset(8) + storeTimestamp(8)
+	// + queueId(4) + topicLength(2) + propertiesLength(2)
+	recordHeaderSize = 4 + 4 + 4 + 8 + 8 + 4 + 2 + 2
+
+	//compressedFlag topicLength 的最高位, 为1时记录内容经过压缩, 内容的第一个字节为压缩算法
+	//topic 的长度不超过 maxTopicLength, 没有压缩的记录最高位总是0, 因此旧的记录不受影响
+	compressedFlag uint16 = 1 << 15
+
+	//maxTopicLength topic 的最大长度
+	maxTopicLength = 1<<15 - 1
+
+	//maxPropertiesLength 编码之后属性的最大长度
+	maxPropertiesLength = 1<<15 - 1
+)
+
+const (
+	//PropertyTags 记录的标签, 用于消费时过滤
+	PropertyTags = "TAGS"
+
+	//PropertyKeys 记录的业务主键, 多个主键之间使用空格分隔
+	PropertyKeys = "KEYS"
+
+	//PropertyDelayTimeLevel 记录的延迟级别, 大于0时记录在对应级别的延迟时间之后才投递
+	PropertyDelayTimeLevel = "DELAY"
+
+	//PropertyRealTopic 延迟记录原始的 topic
+	PropertyRealTopic = "REAL_TOPIC"
+
+	//PropertyRealQueueId 延迟记录原始的队列
+	PropertyRealQueueId = "REAL_QID"
+
+	//PropertyDeliverTime 延迟记录的投递时间, 毫秒
+	PropertyDeliverTime = "DELIVER_TIME"
+
+	//属性名与属性值之间的分隔符
+	nameValueSeparator = '\x01'
+
+	//属性之间的分隔符
+	propertySeparator = '\x02'
+)
+
+var (
+	//ErrNoMoreRecord 当前位置没有写入过数据
+	ErrNoMoreRecord = errors.New("no more record")
+
+	//ErrEndOfFile 读到了文件结束标记, 之后的数据在下一个文件中
+	ErrEndOfFile = errors.New("end of mapped file")
+
+	//ErrIllegalMagicCode 记录的魔数不正确, 说明数据已经损坏或者位置没有对齐到记录的起始位置
+	ErrIllegalMagicCode = errors.New("illegal record magic code")
+
+	//ErrIllegalRecordSize 记录长度超出文件范围
+	ErrIllegalRecordSize = errors.New("illegal record size")
+
+	//ErrCRCMismatch 记录内容的校验和不一致, 通常是写入过程中被中断
+	ErrCRCMismatch = errors.New("record body crc mismatch")
+
+	//ErrInsufficientSpace 文件剩余空间不足以写入记录
+	ErrInsufficientSpace = errors.New("insufficient space in mapped file")
+
+	//ErrTopicTooLong topic 长度超过限制
+	ErrTopicTooLong = errors.New("record topic is too long")
+
+	//ErrPropertiesTooLong 属性编码之后的长度超过限制
+	ErrPropertiesTooLong = errors.New("record properties are too long")
+)
+
+// Record 存储在 MappedFile 中的一条记录
+type Record struct {
+	//记录总长度, 包含记录头
+	TotalSize int32
+
+	MagicCode int32
+
+	//记录内容的CRC32校验和
+	BodyCRC uint32
+
+	//记录在逻辑队列中的偏移量
+	QueueOffset int64
+
+	//记录写入时间, 毫秒
+	StoreTimestamp int64
+
+	//记录所属的队列
+	QueueId int32
+
+	//记录所属的 topic
+	Topic string
+
+	//记录的属性, 属性名与属性值中不能包含分隔符
+	Properties map[string]string
+
+	Body []byte
+
+	//记录内容写入时使用的压缩算法, 读取时 Body 已经解压
+	Compression CompressionType
+
+	//压缩之后写入文件的内容, 包含第一个字节的压缩算法
+	compressedBody []byte
+
+	//读取时记录内容引用的映射区域
+	buffer *MappedBuffer
+}
+
+// NewRecord 创建一条待写入的记录
+func NewRecord(body []byte) *Record {
+	return &Record{
+		Body: body,
+	}
+}
+
+// GetProperty 获取属性值, 属性不存在时返回空字符串
+func (record *Record) GetProperty(name string) string {
+	return record.Properties[name]
+}
+
+// PutProperty 设置属性值
+func (record *Record) PutProperty(name string, value string) {
+	if record.Properties == nil {
+		record.Properties = make(map[string]string)
+	}
+	record.Properties[name] = value
+}
+
+// Tags 记录的标签
+func (record *Record) Tags() string {
+	return record.GetProperty(PropertyTags)
+}
+
+// Keys 记录的业务主键
+func (record *Record) Keys() []string {
+	return strings.Fields(record.GetProperty(PropertyKeys))
+}
+
+// DelayTimeLevel 记录的延迟级别, 没有设置时为0
+func (record *Record) DelayTimeLevel() int {
+	delayLevel, err := strconv.Atoi(record.GetProperty(PropertyDelayTimeLevel))
+	if err != nil {
+		return 0
+	}
+	return delayLevel
+}
+
+// SetDelayTimeLevel 设置记录的延迟级别, 级别对应的延迟时长由 StoreConfig.MessageDelayLevel 配置
+func (record *Record) SetDelayTimeLevel(delayLevel int) {
+	record.PutProperty(PropertyDelayTimeLevel, strconv.Itoa(delayLevel))
+}
+
+// Release 释放记录对文件的引用, 读取到的记录使用完成后需要调用, 释放后不能再访问 Body
+func (record *Record) Release() {
+	if record.buffer != nil {
+		record.buffer.Release()
+		record.buffer = nil
+	}
+}
+
+// Size 记录编码之后的长度, 压缩之后为压缩之后的长度
+func (record *Record) Size() int {
+	return recordHeaderSize + len(record.Topic) + len(encodeProperties(record.Properties)) + len(record.storedBody())
+}
+
+// Compress 使用 compressionType 压缩记录内容, 内容长度小于 threshold 或者压缩之后没有变短时不压缩
+// 压缩不修改 Body, 写入时写入压缩之后的内容
+func (record *Record) Compress(compressionType CompressionType, threshold int) error {
+	record.Compression, record.compressedBody = CompressionNone, nil
+	if compressionType == CompressionNone || len(record.Body) < threshold {
+		return nil
+	}
+
+	codec, err := getCompressionCodec(compressionType)
+	if err != nil {
+		return err
+	}
+
+	compressed, err := codec.Compress(record.Body)
+	if err != nil {
+		return err
+	}
+
+	if len(compressed)+1 >= len(record.Body) {
+		return nil
+	}
+
+	record.Compression = compressionType
+	record.compressedBody = append([]byte{byte(compressionType)}, compressed...)
+	return nil
+}
+
+// isCompressed 写入时是否写入压缩之后的内容, 读取到的记录 Body 已经解压, 重新写入时不再压缩
+func (record *Record) isCompressed() bool {
+	return record.Compression != CompressionNone && record.compressedBody != nil
+}
+
+// storedBody 写入文件的记录内容
+func (record *Record) storedBody() []byte {
+	if record.isCompressed() {
+		return record.compressedBody
+	}
+	return record.Body
+}
+
+// Validate 校验 topic 与属性的长度是否能够编码到记录头中
+func (record *Record) Validate() error {
+	if len(record.Topic) > maxTopicLength {
+		return ErrTopicTooLong
+	}
+
+	if len(encodeProperties(record.Properties)) > maxPropertiesLength {
+		return ErrPropertiesTooLong
+	}
+	return nil
+}
+
+// putStoreTimestamp 修改已经编码的记录的写入时间, 写入时间不在 CRC 的校验范围内
+func putStoreTimestamp(data []byte, storeTimestamp int64) {
+	binary.BigEndian.PutUint64(data[20:28], uint64(storeTimestamp))
+}
+
+// Encode 将记录编码到字节数组中, 同时补全记录头的各个字段
+func (record *Record) Encode() []byte {
+	if record.StoreTimestamp == 0 {
+		record.StoreTimestamp = time.Now().UnixMilli()
+	}
+	properties := encodeProperties(record.Properties)
+	body := record.storedBody()
+	record.TotalSize = int32(recordHeaderSize + len(record.Topic) + len(properties) + len(body))
+	record.MagicCode = MagicCode
+	record.BodyCRC = crc32.ChecksumIEEE(body)
+
+	topicLength := uint16(len(record.Topic))
+	if record.isCompressed() {
+		topicLength |= compressedFlag
+	}
+
+	buffer := make([]byte, record.TotalSize)
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(record.TotalSize))
+	binary.BigEndian.PutUint32(buffer[4:8], uint32(record.MagicCode))
+	binary.BigEndian.PutUint32(buffer[8:12], record.BodyCRC)
+	binary.BigEndian.PutUint64(buffer[12:20], uint64(record.QueueOffset))
+	binary.BigEndian.PutUint64(buffer[20:28], uint64(record.StoreTimestamp))
+	binary.BigEndian.PutUint32(buffer[28:32], uint32(record.QueueId))
+	binary.BigEndian.PutUint16(buffer[32:34], topicLength)
+	binary.BigEndian.PutUint16(buffer[34:36], uint16(len(properties)))
+
+	position := recordHeaderSize
+	position += copy(buffer[position:], record.Topic)
+	position += copy(buffer[position:], properties)
+	copy(buffer[position:], body)
+	return buffer
+}
+
+// DecodeRecord 从字节数组中解析一条记录, 并校验魔数与CRC, 压缩的记录内容会被解压
+// 没有压缩的记录内容引用 data, 调用方需要自行拷贝
+func DecodeRecord(data []byte) (*Record, error) {
+	record, err := decodeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Compression != CompressionNone {
+		if err := record.decompress(); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// decodeRecord 解析记录并校验魔数与CRC, 不解压记录内容, 恢复时只需要确认记录完整
+// 压缩的记录 Body 为压缩之后的内容, 包含第一个字节的压缩算法
+func decodeRecord(data []byte) (*Record, error) {
+	if len(data) < 4 {
+		return nil, ErrNoMoreRecord
+	}
+
+	totalSize := int32(binary.BigEndian.Uint32(data[0:4]))
+	if totalSize == 0 {
+		return nil, ErrNoMoreRecord
+	}
+
+	if len(data) >= blankMarkerSize && int32(binary.BigEndian.Uint32(data[4:8])) == BlankMagicCode {
+		return nil, ErrEndOfFile
+	}
+
+	if totalSize < recordHeaderSize || int(totalSize) > len(data) {
+		return nil, ErrIllegalRecordSize
+	}
+
+	if int32(binary.BigEndian.Uint32(data[4:8])) != MagicCode {
+		return nil, ErrIllegalMagicCode
+	}
+
+	topicLength := binary.BigEndian.Uint16(data[32:34])
+	topicEnd := recordHeaderSize + int32(topicLength&^compressedFlag)
+	propertiesEnd := topicEnd + int32(binary.BigEndian.Uint16(data[34:36]))
+	if propertiesEnd > totalSize {
+		return nil, ErrIllegalRecordSize
+	}
+
+	record := &Record{
+		TotalSize:      totalSize,
+		MagicCode:      MagicCode,
+		BodyCRC:        binary.BigEndian.Uint32(data[8:12]),
+		QueueOffset:    int64(binary.BigEndian.Uint64(data[12:20])),
+		StoreTimestamp: int64(binary.BigEndian.Uint64(data[20:28])),
+		QueueId:        int32(binary.BigEndian.Uint32(data[28:32])),
+		Topic:          string(data[recordHeaderSize:topicEnd]),
+		Properties:     decodeProperties(data[topicEnd:propertiesEnd]),
+		Body:           data[propertiesEnd:totalSize],
+	}
+
+	if crc32.ChecksumIEEE(record.Body) != record.BodyCRC {
+		return nil, ErrCRCMismatch
+	}
+
+	if topicLength&compressedFlag != 0 {
+		if len(record.Body) == 0 {
+			return nil, ErrIllegalRecordSize
+		}
+		record.Compression = CompressionType(record.Body[0])
+	}
+
+	return record, nil
+}
+
+// decompress 解压 decodeRecord 读取的压缩内容
+func (record *Record) decompress() error {
+	codec, err := getCompressionCodec(record.Compression)
+	if err != nil {
+		return err
+	}
+
+	body, err := codec.Decompress(record.Body[1:])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDecompress, err)
+	}
+
+	record.Body = body
+	return nil
+}
+
+// encodeProperties 将属性编码为 name\x01value\x02 的格式, 按照属性名排序保证编码结果稳定
+func encodeProperties(properties map[string]string) []byte {
+	if len(properties) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buffer := make([]byte, 0, 64)
+	for _, name := range names {
+		buffer = append(buffer, name...)
+		buffer = append(buffer, nameValueSeparator)
+		buffer = append(buffer, properties[name]...)
+		buffer = append(buffer, propertySeparator)
+	}
+	return buffer
+}
+
+// decodeProperties 解析 encodeProperties 编码的属性
+func decodeProperties(data []byte) map[string]string {
+	if len(data) == 0 {
+		return nil
+	}
+
+	properties := make(map[string]string)
+	for _, property := range strings.Split(string(data), string(propertySeparator)) {
+		if index := strings.IndexByte(property, nameValueSeparator); index >= 0 {
+			properties[property[:index]] = property[index+1:]
+		}
+	}
+	return properties
+}
+
+// encodeBlankMarker 编码文件结束标记, totalSize 为文件的剩余空间
+func encodeBlankMarker(totalSize int32) []byte {
+	magicCode := BlankMagicCode
+	buffer := make([]byte, blankMarkerSize)
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(totalSize))
+	binary.BigEndian.PutUint32(buffer[4:8], uint32(magicCode))
+	return buffer
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestEncodeAndDecodeRecord(t *testing.T) {
+	record := NewRecord([]byte("book page"))
+	record.QueueOffset = 10
+
+	decoded, err := DecodeRecord(record.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(decoded.Body) != "book page" || decoded.QueueOffset != 10 {
+		t.Fatalf("unexpected record %#v", decoded)
+	}
+
+	if decoded.StoreTimestamp != record.StoreTimestamp || decoded.TotalSize != int32(record.Size()) {
+		t.Fatalf("unexpected record header %#v", decoded)
+	}
+}
+
+func TestDecodeCorruptedRecord(t *testing.T) {
+	data := NewRecord([]byte("book page")).Encode()
+
+	data[len(data)-1] ^= 0xFF
+	if _, err := DecodeRecord(data); err != ErrCRCMismatch {
+		t.Fatalf("expect crc mismatch, got %v", err)
+	}
+
+	data[4] ^= 0xFF
+	if _, err := DecodeRecord(data); err != ErrIllegalMagicCode {
+		t.Fatalf("expect illegal magic code, got %v", err)
+	}
+
+	if _, err := DecodeRecord(make([]byte, recordHeaderSize)); err != ErrNoMoreRecord {
+		t.Fatalf("expect no more record, got %v", err)
+	}
+}
+
+func TestEncodeAndDecodeRecordProperties(t *testing.T) {
+	record := NewRecord([]byte("book page"))
+	record.Topic = "book"
+	record.QueueId = 3
+	record.PutProperty(PropertyTags, "novel")
+	record.PutProperty(PropertyKeys, "1001 1002")
+
+	decoded, err := DecodeRecord(record.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Topic != "book" || decoded.QueueId != 3 || decoded.Tags() != "novel" || string(decoded.Body) != "book page" {
+		t.Fatalf("unexpected record %#v", decoded)
+	}
+
+	if keys := decoded.Keys(); len(keys) != 2 || keys[0] != "1001" || keys[1] != "1002" {
+		t.Fatalf("unexpected record keys %v", keys)
+	}
+}
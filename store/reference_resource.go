@@ -0,0 +1,87 @@
+package store
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ReferenceResource 引用计数, 创建时计数为1, 计数减为0时执行清理
+// 资源关闭后不再允许新的引用, 已有的引用全部释放之后才会清理
+type ReferenceResource struct {
+	refCount int64
+
+	//资源是否可用, 关闭后不允许新的引用
+	available int32
+
+	//清理是否已经完成
+	cleanupOver int32
+
+	//第一次关闭的时间, 毫秒
+	firstShutdownTimestamp int64
+
+	//计数减为0时执行的清理方法
+	cleanup func()
+}
+
+func newReferenceResource(cleanup func()) ReferenceResource {
+	return ReferenceResource{
+		refCount:  1,
+		available: 1,
+		cleanup:   cleanup,
+	}
+}
+
+// Hold 增加引用, 资源已经关闭时返回false
+func (resource *ReferenceResource) Hold() bool {
+	if resource.IsAvailable() {
+		if atomic.AddInt64(&resource.refCount, 1) > 1 {
+			return true
+		}
+		atomic.AddInt64(&resource.refCount, -1)
+	}
+
+	return false
+}
+
+// Release 释放引用, 计数减为0时执行清理
+func (resource *ReferenceResource) Release() {
+	if atomic.AddInt64(&resource.refCount, -1) > 0 {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&resource.cleanupOver, 0, 1) {
+		resource.cleanup()
+	}
+}
+
+// Shutdown 关闭资源, 释放创建时的引用
+// 再次调用时如果距离第一次关闭已经超过 intervalForcibly, 则不再等待未释放的引用直接清理
+func (resource *ReferenceResource) Shutdown(intervalForcibly time.Duration) {
+	if atomic.CompareAndSwapInt32(&resource.available, 1, 0) {
+		atomic.StoreInt64(&resource.firstShutdownTimestamp, time.Now().UnixMilli())
+		resource.Release()
+		return
+	}
+
+	if resource.GetRefCount() > 0 && time.Now().UnixMilli()-atomic.LoadInt64(&resource.firstShutdownTimestamp) >= intervalForcibly.Milliseconds() {
+		atomic.StoreInt64(&resource.refCount, 0)
+		if atomic.CompareAndSwapInt32(&resource.cleanupOver, 0, 1) {
+			resource.cleanup()
+		}
+	}
+}
+
+// IsAvailable 资源是否可用
+func (resource *ReferenceResource) IsAvailable() bool {
+	return atomic.LoadInt32(&resource.available) == 1
+}
+
+// IsCleanupOver 资源是否已经清理完成
+func (resource *ReferenceResource) IsCleanupOver() bool {
+	return atomic.LoadInt32(&resource.cleanupOver) == 1
+}
+
+// GetRefCount 当前的引用计数
+func (resource *ReferenceResource) GetRefCount() int64 {
+	return atomic.LoadInt64(&resource.refCount)
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//maxReputBackoff 分发出错之后重试的最长间隔
+	maxReputBackoff = time.Second
+)
+
+// DispatchRequest 分发给索引的记录信息
+type DispatchRequest struct {
+	Topic string
+
+	QueueId int32
+
+	//记录在 commit log 中的偏移量
+	CommitLogOffset int64
+
+	//记录的长度
+	Size int32
+
+	//记录在逻辑队列中的偏移量
+	QueueOffset int64
+
+	//记录标签的哈希值
+	TagsCode int64
+
+	StoreTimestamp int64
+
+	//记录的业务主键
+	Keys []string
+}
+
+func newDispatchRequest(record *Record, commitLogOffset int64) *DispatchRequest {
+	//延迟记录索引条目的 TagsCode 为投递时间, 用于判断记录是否到期
+	tagsCode := tagsCodeOf(record.Tags())
+	if record.Topic == ScheduleTopic {
+		tagsCode = deliverTimestampOf(record)
+	}
+
+	return &DispatchRequest{
+		Topic:           record.Topic,
+		QueueId:         record.QueueId,
+		CommitLogOffset: commitLogOffset,
+		Size:            record.TotalSize,
+		QueueOffset:     record.QueueOffset,
+		TagsCode:        tagsCode,
+		StoreTimestamp:  record.StoreTimestamp,
+		Keys:            record.Keys(),
+	}
+}
+
+// CommitLogDispatcher 根据 commit log 中的记录构建索引
+type CommitLogDispatcher interface {
+	Dispatch(request *DispatchRequest)
+}
+
+// ReputService 分发服务, 顺序读取 commit log 中新写入的记录并分发给所有的 CommitLogDispatcher
+type ReputService struct {
+	store *MessageStore
+
+	interval time.Duration
+
+	//下一条需要分发的记录在 commit log 中的偏移量
+	reputFromOffset int64
+
+	//上一次读取失败的位置, 同一个位置的错误只记录一次日志, 只在分发协程中访问
+	errorOffset int64
+
+	wakeupCh chan struct{}
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+
+	//有新的记录分发完成时唤醒等待新记录的协程
+	arriving ArrivingNotifier
+}
+
+func NewReputService(store *MessageStore, interval time.Duration) *ReputService {
+	return &ReputService{
+		store:       store,
+		interval:    interval,
+		errorOffset: -1,
+		wakeupCh:    make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// arrivingNotify 获取新记录的通知, 之后有新的记录分发完成时通道会被关闭
+func (service *ReputService) arrivingNotify() <-chan struct{} {
+	return service.arriving.Wait()
+}
+
+func (service *ReputService) Start() {
+	service.waitGroup.Add(1)
+	go service.run()
+}
+
+// Shutdown 停止分发, 停止前会将已经写入的记录全部分发
+func (service *ReputService) Shutdown() {
+	close(service.stopCh)
+	service.waitGroup.Wait()
+}
+
+func (service *ReputService) Wakeup() {
+	select {
+	case service.wakeupCh <- struct{}{}:
+	default:
+	}
+}
+
+// GetReputFromOffset 下一条需要分发的记录在 commit log 中的偏移量
+func (service *ReputService) GetReputFromOffset() int64 {
+	return atomic.LoadInt64(&service.reputFromOffset)
+}
+
+func (service *ReputService) setReputFromOffset(offset int64) {
+	atomic.StoreInt64(&service.reputFromOffset, offset)
+}
+
+func (service *ReputService) run() {
+	defer service.waitGroup.Done()
+
+	timer := time.NewTimer(service.interval)
+	defer timer.Stop()
+
+	//commit log 中可以读取的数据增加时立即分发, 使用写入缓冲池时数据在提交之后才能读取
+	//读取出错时定时重试的间隔逐渐增加, 直到 maxReputBackoff
+	arriving := service.store.CommitLog.arriving.Wait()
+	wait := service.interval
+	for {
+		select {
+		case <-service.stopCh:
+			service.doReput()
+			return
+		case <-service.wakeupCh:
+		case <-arriving:
+		case <-timer.C:
+		}
+
+		arriving = service.store.CommitLog.arriving.Wait()
+		if err := service.doReput(); err != nil {
+			wait *= 2
+			if wait > maxReputBackoff {
+				wait = maxReputBackoff
+			}
+		} else {
+			wait = service.interval
+		}
+		timer.Reset(wait)
+	}
+}
+
+// doReput 分发 reputFromOffset 之后所有可以读取的记录, 返回读取 commit log 时出现的错误
+func (service *ReputService) doReput() error {
+	commitLog := service.store.CommitLog
+	reputFromOffset := service.GetReputFromOffset()
+	if minOffset := commitLog.GetMinOffset(); reputFromOffset < minOffset {
+		Logger.Warnf("分发位置 %d 所在的文件已经被删除, 从 %d 开始分发", reputFromOffset, minOffset)
+		reputFromOffset = minOffset
+	}
+
+	it := commitLog.Iterator(reputFromOffset)
+	defer it.Close()
+
+	dispatched := false
+	for it.Next() {
+		request := newDispatchRequest(it.Record(), it.Offset())
+		for _, dispatcher := range service.store.dispatchers {
+			dispatcher.Dispatch(request)
+		}
+		service.setReputFromOffset(it.NextOffset())
+		dispatched = true
+	}
+
+	if dispatched {
+		service.arriving.NotifyAll()
+	}
+
+	if err := it.Err(); err != nil {
+		if service.errorOffset != it.NextOffset() {
+			service.errorOffset = it.NextOffset()
+			Logger.Errorf("分发位置 %d 的记录读取失败, 等待重试: %v", it.NextOffset(), err)
+		}
+		return err
+	}
+
+	//读到文件结束标记时下一条记录位于下一个文件的起始位置
+	service.setReputFromOffset(it.NextOffset())
+	service.errorOffset = -1
+	return nil
+}
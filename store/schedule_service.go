@@ -0,0 +1,230 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//ScheduleTopic 延迟记录在投递之前写入的内部 topic, 每个延迟级别对应一个队列, 队列编号为级别减一
+	ScheduleTopic = "SCHEDULE_TOPIC_XXXX"
+
+	//scheduleGroup 保存每个延迟级别投递进度的内部消费组
+	scheduleGroup = "SCHEDULE_CONSUMER"
+)
+
+var (
+	//ErrIllegalDelayLevel 延迟级别配置无法解析
+	ErrIllegalDelayLevel = errors.New("illegal message delay level")
+)
+
+// ParseDelayLevel 解析使用空格分隔的延迟级别配置, 例如 "1s 5s 10s 1m", 第 i 个时长对应级别 i+1
+func ParseDelayLevel(delayLevel string) ([]time.Duration, error) {
+	fields := strings.Fields(delayLevel)
+	delayLevelTable := make([]time.Duration, 0, len(fields))
+	for _, field := range fields {
+		delay, err := time.ParseDuration(field)
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrIllegalDelayLevel, field)
+		}
+		delayLevelTable = append(delayLevelTable, delay)
+	}
+
+	return delayLevelTable, nil
+}
+
+// ScheduleService 延迟记录的投递服务
+// 设置了延迟级别的记录写入时被替换到 ScheduleTopic 中对应级别的队列, 索引条目的 TagsCode 为投递时间
+// 同一个级别的记录按照写入顺序到期, 服务定时检查每个级别的队列, 将到期的记录重新写入原始的 topic 与队列
+// 投递进度保存在消费进度中, 重启之后从上一次持久化的进度继续投递, 异常退出时可能重复投递
+type ScheduleService struct {
+	store *MessageStore
+
+	//检查到期记录的时间间隔
+	interval time.Duration
+
+	//级别 i+1 对应的延迟时长, 在 Load 时解析
+	delayLevelTable []time.Duration
+
+	stopCh chan struct{}
+
+	waitGroup sync.WaitGroup
+}
+
+func NewScheduleService(store *MessageStore, interval time.Duration) *ScheduleService {
+	return &ScheduleService{
+		store:           store,
+		interval:        interval,
+		delayLevelTable: make([]time.Duration, 0),
+		stopCh:          make(chan struct{}),
+	}
+}
+
+// Load 解析延迟级别配置
+func (service *ScheduleService) Load(delayLevel string) error {
+	delayLevelTable, err := ParseDelayLevel(delayLevel)
+	if err != nil {
+		return err
+	}
+
+	service.delayLevelTable = delayLevelTable
+	return nil
+}
+
+// GetMaxDelayLevel 最大的延迟级别, 没有配置延迟级别时为0
+func (service *ScheduleService) GetMaxDelayLevel() int {
+	return len(service.delayLevelTable)
+}
+
+// toScheduleRecord 将延迟记录替换到对应级别的队列, 原始的 topic、队列与投递时间保存在属性中
+// 超过最大级别时按照最大级别延迟
+func (service *ScheduleService) toScheduleRecord(record *Record, delayLevel int) {
+	if delayLevel > service.GetMaxDelayLevel() {
+		delayLevel = service.GetMaxDelayLevel()
+		record.SetDelayTimeLevel(delayLevel)
+	}
+
+	//写入时间在写入锁内设置, 这里只用于计算投递时间, 保证 commit log 中的写入时间单调递增
+	storeTimestamp := record.StoreTimestamp
+	if storeTimestamp == 0 {
+		storeTimestamp = time.Now().UnixMilli()
+	}
+
+	deliverTimestamp := storeTimestamp + service.delayLevelTable[delayLevel-1].Milliseconds()
+	record.PutProperty(PropertyRealTopic, record.Topic)
+	record.PutProperty(PropertyRealQueueId, strconv.FormatInt(int64(record.QueueId), 10))
+	record.PutProperty(PropertyDeliverTime, strconv.FormatInt(deliverTimestamp, 10))
+	record.Topic = ScheduleTopic
+	record.QueueId = int32(delayLevel - 1)
+}
+
+func (service *ScheduleService) Start() {
+	service.waitGroup.Add(1)
+	go service.run()
+}
+
+func (service *ScheduleService) Shutdown() {
+	close(service.stopCh)
+	service.waitGroup.Wait()
+}
+
+func (service *ScheduleService) run() {
+	defer service.waitGroup.Done()
+
+	ticker := time.NewTicker(service.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-service.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		for delayLevel := 1; delayLevel <= service.GetMaxDelayLevel(); delayLevel++ {
+			service.deliverDueRecords(delayLevel)
+		}
+	}
+}
+
+// deliverDueRecords 投递级别队列中所有已经到期的记录, 遇到没有到期的记录或者投递失败时停止, 下一次检查时继续
+func (service *ScheduleService) deliverDueRecords(delayLevel int) {
+	queueId := int32(delayLevel - 1)
+	cq, err := service.store.findConsumeQueue(ScheduleTopic, queueId, false)
+	if err != nil {
+		return
+	}
+
+	offsetManager := service.store.offsetManager
+	offset := offsetManager.QueryOffset(scheduleGroup, ScheduleTopic, queueId)
+	if minOffset := cq.minOffsetInQueueFrom(service.store.CommitLog.GetMinOffset()); offset < minOffset {
+		offset = minOffset
+	}
+
+	startOffset := offset
+	now := time.Now().UnixMilli()
+	for maxOffset := cq.GetMaxOffsetInQueue(); offset < maxOffset; offset++ {
+		entry, err := cq.GetEntry(offset)
+		if errors.Is(err, ErrBlankEntry) {
+			continue
+		}
+
+		if err != nil {
+			Logger.Errorf("读取延迟队列 %d 偏移量 %d 的索引失败: %v", delayLevel, offset, err)
+			break
+		}
+
+		//索引条目的 TagsCode 为投递时间
+		if entry.TagsCode > now {
+			break
+		}
+
+		if err := service.deliver(entry.CommitLogOffset); err != nil {
+			Logger.Errorf("投递延迟记录失败, 级别: %d, 偏移量: %d, %v", delayLevel, offset, err)
+			break
+		}
+	}
+
+	if offset != startOffset {
+		offsetManager.CommitOffset(scheduleGroup, ScheduleTopic, queueId, offset)
+	}
+}
+
+// deliver 读取延迟记录, 恢复原始的 topic 与队列之后重新写入
+func (service *ScheduleService) deliver(commitLogOffset int64) error {
+	record, err := service.store.CommitLog.ReadRecord(commitLogOffset)
+	if errors.Is(err, ErrOffsetDeleted) {
+		//记录所在的文件已经被清理, 无法再投递, 跳过避免阻塞之后的记录
+		Logger.Errorf("延迟记录 %d 所在的文件已经被删除, 已跳过", commitLogOffset)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer record.Release()
+
+	realRecord, err := restoreScheduleRecord(record)
+	if err != nil {
+		//属性不完整的记录无法投递, 跳过避免阻塞之后的记录
+		Logger.Errorf("延迟记录 %d 无法投递, 已跳过: %v", commitLogOffset, err)
+		return nil
+	}
+
+	_, err = service.store.PutRecord(realRecord)
+	return err
+}
+
+// restoreScheduleRecord 根据延迟记录创建投递到原始 topic 与队列的记录, 去掉延迟相关的属性
+func restoreScheduleRecord(record *Record) (*Record, error) {
+	queueId, err := strconv.ParseInt(record.GetProperty(PropertyRealQueueId), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	realRecord := NewRecord(record.Body)
+	realRecord.Topic = record.GetProperty(PropertyRealTopic)
+	realRecord.QueueId = int32(queueId)
+	for name, value := range record.Properties {
+		switch name {
+		case PropertyDelayTimeLevel, PropertyRealTopic, PropertyRealQueueId, PropertyDeliverTime:
+		default:
+			realRecord.PutProperty(name, value)
+		}
+	}
+
+	return realRecord, nil
+}
+
+// deliverTimestampOf 延迟记录的投递时间, 属性不存在时立即投递
+func deliverTimestampOf(record *Record) int64 {
+	deliverTimestamp, err := strconv.ParseInt(record.GetProperty(PropertyDeliverTime), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return deliverTimestamp
+}
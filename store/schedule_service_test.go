@@ -0,0 +1,164 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestScheduleStore(t *testing.T, rootDir string) *MessageStore {
+	config := newTestStoreConfig()
+	config.MessageDelayLevel = "50ms 300ms"
+	config.ScheduleInterval = 10 * time.Millisecond
+
+	store := NewMessageStore(rootDir, config)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	store.Start()
+	return store
+}
+
+// waitForQueueOffset 等待队列中的记录数量达到 maxOffset
+func waitForQueueOffset(t *testing.T, store *MessageStore, topic string, queueId int32, maxOffset int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for store.GetMaxOffsetInQueue(topic, queueId) < maxOffset {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d records in %s-%d, got %d", maxOffset, topic, queueId, store.GetMaxOffsetInQueue(topic, queueId))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestParseDelayLevel(t *testing.T) {
+	delayLevelTable, err := ParseDelayLevel("1s 5s  1m 2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []time.Duration{time.Second, 5 * time.Second, time.Minute, 2 * time.Hour}
+	if len(delayLevelTable) != len(expected) {
+		t.Fatalf("expect %d levels, got %d", len(expected), len(delayLevelTable))
+	}
+	for i, delay := range expected {
+		if delayLevelTable[i] != delay {
+			t.Fatalf("expect level %d delay %v, got %v", i+1, delay, delayLevelTable[i])
+		}
+	}
+
+	if _, err := ParseDelayLevel("1s 1d"); !errors.Is(err, ErrIllegalDelayLevel) {
+		t.Fatalf("expect illegal delay level, got %v", err)
+	}
+}
+
+func TestScheduleServiceDeliverDueRecords(t *testing.T) {
+	store := newTestScheduleStore(t, t.TempDir())
+	defer store.Shutdown()
+
+	record := newTestTopicRecord("book", 1, 0)
+	record.PutProperty(PropertyKeys, "page-1")
+	record.SetDelayTimeLevel(1)
+	begin := time.Now()
+	if _, err := store.PutRecord(record); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.PutRecord(newTestTopicRecord(ScheduleTopic, 0, 1)); err != ErrIllegalTopic {
+		t.Fatalf("expect illegal topic, got %v", err)
+	}
+
+	waitForDispatch(t, store)
+	if maxOffset := store.GetMaxOffsetInQueue(ScheduleTopic, 0); maxOffset != 1 {
+		t.Fatalf("expect record parked in schedule queue, got max offset %d", maxOffset)
+	}
+
+	waitForQueueOffset(t, store, "book", 1, 1)
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+		t.Fatalf("record delivered after %v, earlier than delay", elapsed)
+	}
+
+	delivered, err := store.GetRecord("book", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delivered.Release()
+
+	if !bytes.Equal(delivered.Body, testBody(0)) || delivered.Tags() != "tag" || delivered.GetProperty(PropertyKeys) != "page-1" {
+		t.Fatalf("unexpected delivered record %#v", delivered)
+	}
+
+	if delivered.DelayTimeLevel() != 0 || delivered.GetProperty(PropertyRealTopic) != "" || delivered.GetProperty(PropertyDeliverTime) != "" {
+		t.Fatalf("expect delay properties removed, got %v", delivered.Properties)
+	}
+}
+
+func TestScheduleServiceSurviveRestart(t *testing.T) {
+	rootDir := t.TempDir()
+	store := newTestScheduleStore(t, rootDir)
+
+	//超过最大级别时按照最大级别延迟
+	record := newTestTopicRecord("book", 0, 0)
+	record.SetDelayTimeLevel(10)
+	if _, err := store.PutRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	store.Shutdown()
+
+	store = newTestScheduleStore(t, rootDir)
+	if maxOffset := store.GetMaxOffsetInQueue(ScheduleTopic, 1); maxOffset != 1 {
+		t.Fatalf("expect record in max level queue, got max offset %d", maxOffset)
+	}
+	waitForQueueOffset(t, store, "book", 0, 1)
+	store.Shutdown()
+
+	//投递进度已经持久化, 重启之后不会重复投递
+	store = newTestScheduleStore(t, rootDir)
+	defer store.Shutdown()
+
+	time.Sleep(50 * time.Millisecond)
+	if maxOffset := store.GetMaxOffsetInQueue("book", 0); maxOffset != 1 {
+		t.Fatalf("expect record delivered once, got max offset %d", maxOffset)
+	}
+}
+
+func TestScheduleServiceSkipDeletedRecords(t *testing.T) {
+	store := newTestScheduleStore(t, t.TempDir())
+	defer store.Shutdown()
+
+	deleted := newTestTopicRecord("book", 1, 0)
+	deleted.SetDelayTimeLevel(2)
+	if _, err := store.PutRecord(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	//写入足够多的记录切换文件之后删除延迟记录所在的文件
+	for i := 0; i < 60; i++ {
+		if _, err := store.PutRecord(newTestTopicRecord("page", 0, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForDispatch(t, store)
+	flushAll(store.CommitLog)
+	if store.CommitLog.DeleteExpiredFiles(0, time.Hour, true, 10) == 0 {
+		t.Fatal("expect commit log files deleted")
+	}
+
+	//之后的延迟记录不会被无法投递的记录阻塞
+	record := newTestTopicRecord("book", 1, 1)
+	record.SetDelayTimeLevel(2)
+	if _, err := store.PutRecord(record); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForQueueOffset(t, store, "book", 1, 1)
+	got, err := store.GetRecord("book", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.Release()
+
+	if !bytes.Equal(got.Body, testBody(1)) {
+		t.Fatalf("unexpected delivered record %q", got.Body)
+	}
+}
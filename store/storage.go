@@ -0,0 +1,332 @@
+package store
+
+import (
+	"fmt"
+	"github.com/edsrzf/mmap-go"
+	"github.com/spf13/afero"
+	"io"
+	"k8s.io/apimachinery/pkg/util/errors"
+	"os"
+	"sync"
+)
+
+// Storage 文件的存储后端, MappedFileQueue 通过存储后端管理目录与文件, MappedFile 通过存储后端获得可以直接读写的内存区域
+type Storage interface {
+	//MkdirAll 创建目录
+	MkdirAll(dir string) error
+
+	//ReadDir 返回目录下的所有文件, 按照文件名排序
+	ReadDir(dir string) ([]os.FileInfo, error)
+
+	//Stat 获取文件信息, 文件不存在时返回的错误满足 os.IsNotExist
+	Stat(fileName string) (os.FileInfo, error)
+
+	//Remove 删除文件
+	Remove(fileName string) error
+
+	//Rename 重命名文件, 目标文件存在时替换
+	Rename(oldName string, newName string) error
+
+	//ReadFile 读取文件的全部内容
+	ReadFile(fileName string) ([]byte, error)
+
+	//WriteFile 写入文件的全部内容并刷盘, 文件不存在时创建
+	WriteFile(fileName string, data []byte) error
+
+	//OpenRegion 打开或者创建文件并映射 size 字节, 文件不足 size 时扩展, 超过 size 时返回错误
+	//deleteIfExists 为true时清空文件已有的内容
+	OpenRegion(fileName string, size int64, deleteIfExists bool) (Region, error)
+
+	//UsageRatio 目录所在存储空间的使用率
+	UsageRatio(dir string) (float64, error)
+}
+
+// Region 文件映射到内存的区域, 写入的数据需要 Flush 之后才能保证持久化
+type Region interface {
+	//Bytes 可以直接读写的内存区域, 长度为映射的大小
+	Bytes() []byte
+
+	//Flush 将 [offset, offset+length) 范围内的数据写回存储, 实现可以写回更大的范围
+	Flush(offset int64, length int64) error
+
+	//Close 解除映射并关闭文件, 关闭之后不能再访问 Bytes 返回的区域
+	Close() error
+}
+
+// WarmUpRegion 支持预先分配磁盘空间、预读与锁定内存的映射区域
+type WarmUpRegion interface {
+	Region
+
+	//Fallocate 为文件预先分配磁盘空间
+	Fallocate() error
+
+	//WillNeed 通知内核即将访问映射区域
+	WillNeed() error
+
+	//Lock 将映射区域锁定在内存中
+	Lock() error
+}
+
+// MmapStorage 基于操作系统文件与内存映射的存储后端
+type MmapStorage struct {
+	fs afero.Fs
+}
+
+func NewMmapStorage() *MmapStorage {
+	return &MmapStorage{
+		fs: afero.NewOsFs(),
+	}
+}
+
+func (storage *MmapStorage) MkdirAll(dir string) error {
+	return storage.fs.MkdirAll(dir, os.ModePerm)
+}
+
+func (storage *MmapStorage) ReadDir(dir string) ([]os.FileInfo, error) {
+	return afero.ReadDir(storage.fs, dir)
+}
+
+func (storage *MmapStorage) Stat(fileName string) (os.FileInfo, error) {
+	return storage.fs.Stat(fileName)
+}
+
+func (storage *MmapStorage) Remove(fileName string) error {
+	return storage.fs.Remove(fileName)
+}
+
+func (storage *MmapStorage) Rename(oldName string, newName string) error {
+	return storage.fs.Rename(oldName, newName)
+}
+
+func (storage *MmapStorage) ReadFile(fileName string) ([]byte, error) {
+	return afero.ReadFile(storage.fs, fileName)
+}
+
+func (storage *MmapStorage) WriteFile(fileName string, data []byte) error {
+	return writeFileSync(storage.fs, fileName, data)
+}
+
+func (storage *MmapStorage) OpenRegion(fileName string, size int64, deleteIfExists bool) (Region, error) {
+	file, err := openOrCreateFile(fileName, deleteIfExists)
+	if err != nil {
+		return nil, err
+	}
+
+	//文件长度不足时需要先扩展, 否则访问超出文件长度的映射区域会触发SIGBUS
+	if err = ensureFileSize(file, size); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	mappedRegion, err := mmap.MapRegion(file, int(size), mmap.RDWR, 0, 0)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &mmapRegion{
+		file:   file,
+		region: mappedRegion,
+	}, nil
+}
+
+func (storage *MmapStorage) UsageRatio(dir string) (float64, error) {
+	return diskUsageRatio(dir)
+}
+
+// mmapRegion 文件的内存映射
+type mmapRegion struct {
+	file *os.File
+
+	region mmap.MMap
+}
+
+func (region *mmapRegion) Bytes() []byte {
+	return region.region
+}
+
+// Flush 内存映射只能整体刷盘
+func (region *mmapRegion) Flush(offset int64, length int64) error {
+	return region.region.Flush()
+}
+
+func (region *mmapRegion) Close() error {
+	compositeError := make([]error, 0)
+	if err := region.region.Unmap(); err != nil {
+		compositeError = append(compositeError, err)
+	}
+
+	if err := region.file.Close(); err != nil {
+		compositeError = append(compositeError, err)
+	}
+
+	return errors.NewAggregate(compositeError)
+}
+
+func (region *mmapRegion) Fallocate() error {
+	return fallocate(region.file, int64(len(region.region)))
+}
+
+func (region *mmapRegion) WillNeed() error {
+	return madviseWillNeed(region.region)
+}
+
+func (region *mmapRegion) Lock() error {
+	return region.region.Lock()
+}
+
+// HeapStorage 基于 afero 文件系统的存储后端, 映射区域为堆上的内存
+// 打开文件时读取全部内容, Flush 时写回文件, 使用 afero.NewMemMapFs 时所有数据都保存在内存中, 用于测试
+type HeapStorage struct {
+	fs afero.Fs
+}
+
+func NewHeapStorage(fs afero.Fs) *HeapStorage {
+	return &HeapStorage{
+		fs: fs,
+	}
+}
+
+func (storage *HeapStorage) MkdirAll(dir string) error {
+	return storage.fs.MkdirAll(dir, os.ModePerm)
+}
+
+func (storage *HeapStorage) ReadDir(dir string) ([]os.FileInfo, error) {
+	return afero.ReadDir(storage.fs, dir)
+}
+
+func (storage *HeapStorage) Stat(fileName string) (os.FileInfo, error) {
+	return storage.fs.Stat(fileName)
+}
+
+func (storage *HeapStorage) Remove(fileName string) error {
+	return storage.fs.Remove(fileName)
+}
+
+func (storage *HeapStorage) Rename(oldName string, newName string) error {
+	return storage.fs.Rename(oldName, newName)
+}
+
+func (storage *HeapStorage) ReadFile(fileName string) ([]byte, error) {
+	return afero.ReadFile(storage.fs, fileName)
+}
+
+func (storage *HeapStorage) WriteFile(fileName string, data []byte) error {
+	return writeFileSync(storage.fs, fileName, data)
+}
+
+func (storage *HeapStorage) OpenRegion(fileName string, size int64, deleteIfExists bool) (Region, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if deleteIfExists {
+		flag |= os.O_TRUNC
+	}
+
+	file, err := storage.fs.OpenFile(fileName, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if stat.Size() > size {
+		_ = file.Close()
+		return nil, fmt.Errorf("file %s size %d is larger than mapped size %d", fileName, stat.Size(), size)
+	}
+
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data[:stat.Size()], 0); err != nil && err != io.EOF {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if stat.Size() < size {
+		if err := file.Truncate(size); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+
+	return &heapRegion{
+		file: file,
+		data: data,
+	}, nil
+}
+
+// UsageRatio 堆上的存储不占用磁盘空间
+func (storage *HeapStorage) UsageRatio(dir string) (float64, error) {
+	return 0, nil
+}
+
+// heapRegion 堆上的映射区域, 写回时只写入指定的范围, 避免读取正在写入的数据
+type heapRegion struct {
+	file afero.File
+
+	data []byte
+
+	//保证同一时刻只有一个协程在写回
+	lock sync.Mutex
+}
+
+func (region *heapRegion) Bytes() []byte {
+	return region.data
+}
+
+func (region *heapRegion) Flush(offset int64, length int64) error {
+	size := int64(len(region.data))
+	if offset < 0 {
+		offset = 0
+	}
+
+	end := offset + length
+	if end > size {
+		end = size
+	}
+
+	if offset >= end {
+		return nil
+	}
+
+	region.lock.Lock()
+	defer region.lock.Unlock()
+	if _, err := region.file.WriteAt(region.data[offset:end], offset); err != nil {
+		return err
+	}
+	return region.file.Sync()
+}
+
+// Close 写回全部数据之后关闭文件, 与解除内存映射之后数据仍然保留在页缓存中一致
+func (region *heapRegion) Close() error {
+	compositeError := make([]error, 0)
+	if err := region.Flush(0, int64(len(region.data))); err != nil {
+		compositeError = append(compositeError, err)
+	}
+
+	if err := region.file.Close(); err != nil {
+		compositeError = append(compositeError, err)
+	}
+
+	return errors.NewAggregate(compositeError)
+}
+
+// writeFileSync 写入文件并刷盘
+func writeFileSync(fs afero.Fs, fileName string, data []byte) error {
+	file, err := fs.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
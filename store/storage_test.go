@@ -0,0 +1,134 @@
+package store
+
+import (
+	"bytes"
+	"github.com/spf13/afero"
+	"os"
+	"testing"
+	"time"
+)
+
+// newMemoryQueue 创建所有文件都保存在内存中的队列, 每个文件恰好容纳 recordsPerFile 条记录
+func newMemoryQueue(t *testing.T, storage Storage, recordsPerFile int) *MappedFileQueue {
+	queue := NewMappedFileQueue("/store/commitlog", int64(recordsPerFile*(recordHeaderSize+100)))
+	queue.Storage = storage
+	if err := queue.Load(); err != nil {
+		t.Fatal(err)
+	}
+	queue.Recover()
+	return queue
+}
+
+func TestHeapStorageRegion(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := NewHeapStorage(fs)
+
+	region, err := storage.OpenRegion("/data/00000000000000000000", 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(region.Bytes(), "hello")
+	copy(region.Bytes()[32:], "world")
+	if err := region.Flush(0, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	//只有写回的范围会写入文件
+	data, err := afero.ReadFile(fs, "/data/00000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 64 || string(data[:5]) != "hello" || data[32] != 0 {
+		t.Fatalf("unexpected file content %q", data)
+	}
+
+	//关闭时写回全部数据
+	if err := region.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	region, err = storage.OpenRegion("/data/00000000000000000000", 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(region.Bytes()[32:37]) != "world" {
+		t.Fatalf("unexpected region content %q", region.Bytes())
+	}
+	_ = region.Close()
+
+	if _, err := storage.OpenRegion("/data/00000000000000000000", 32, false); err == nil {
+		t.Fatal("expect error when file is larger than mapped size")
+	}
+}
+
+func TestMemoryQueueRollAndRecover(t *testing.T) {
+	storage := NewHeapStorage(afero.NewMemMapFs())
+	queue := newMemoryQueue(t, storage, 4)
+
+	for i := 0; i < 10; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(queue.getMappedFiles()) != 3 {
+		t.Fatalf("expect 3 mapped files, got %d", len(queue.getMappedFiles()))
+	}
+
+	entries, err := storage.ReadDir(queue.FileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expect 3 mapped files and checkpoint, got %d entries", len(entries))
+	}
+
+	maxOffset := queue.GetMaxOffset()
+	queue.Shutdown()
+
+	reopened := newMemoryQueue(t, storage, 4)
+	defer reopened.Shutdown()
+
+	if reopened.IsAbnormalShutdown() || reopened.GetMaxOffset() != maxOffset {
+		t.Fatalf("expect clean shutdown with max offset %d, got %d", maxOffset, reopened.GetMaxOffset())
+	}
+
+	it := reopened.Iterator(0)
+	defer it.Close()
+	count := 0
+	for ; it.Next(); count++ {
+		if !bytes.Equal(it.Record().Body, testBody(count)) {
+			t.Fatalf("unexpected record %d", count)
+		}
+	}
+	if count != 10 {
+		t.Fatalf("expect 10 records, got %d", count)
+	}
+}
+
+func TestMemoryQueueDeleteExpiredFiles(t *testing.T) {
+	storage := NewHeapStorage(afero.NewMemMapFs())
+	queue := newMemoryQueue(t, storage, 1)
+	defer queue.Shutdown()
+
+	for i := 0; i < 5; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(queue)
+
+	firstFile := queue.getFirstFile()
+	if deleted := queue.DeleteExpiredFiles(0, time.Hour, false, 10); deleted != 4 {
+		t.Fatalf("expect 4 files deleted, got %d", deleted)
+	}
+
+	if _, err := storage.Stat(firstFile.FileName); !os.IsNotExist(err) {
+		t.Fatalf("expect %s to be removed, got %v", firstFile.FileName, err)
+	}
+
+	if queue.GetMinOffset() != 4*queue.FileSize {
+		t.Fatalf("unexpected min offset %d", queue.GetMinOffset())
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"sync"
+)
+
+// TransientStorePool 写入缓冲池, 每个缓冲区与文件大小相同
+// 启用后写入方先将数据写入缓冲区, 再由提交协程拷贝到文件映射区域, 避免写入方直接访问页缓存时产生缺页中断
+type TransientStorePool struct {
+	//缓冲区数量
+	poolSize int
+
+	//每个缓冲区的大小, 与文件大小一致
+	fileSize int64
+
+	lock sync.Mutex
+
+	//可以借出的缓冲区
+	availableBuffers [][]byte
+}
+
+func NewTransientStorePool(poolSize int, fileSize int64) *TransientStorePool {
+	return &TransientStorePool{
+		poolSize: poolSize,
+		fileSize: fileSize,
+	}
+}
+
+// Init 预先分配所有的缓冲区
+func (pool *TransientStorePool) Init() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.availableBuffers = make([][]byte, 0, pool.poolSize)
+	for i := 0; i < pool.poolSize; i++ {
+		pool.availableBuffers = append(pool.availableBuffers, make([]byte, pool.fileSize))
+	}
+}
+
+// Destroy 释放所有空闲的缓冲区, 已经借出的缓冲区归还后同样会被丢弃
+func (pool *TransientStorePool) Destroy() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.availableBuffers = nil
+	pool.poolSize = 0
+}
+
+// BorrowBuffer 借出一个缓冲区, 没有空闲的缓冲区时返回nil
+func (pool *TransientStorePool) BorrowBuffer() []byte {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	count := len(pool.availableBuffers)
+	if count == 0 {
+		return nil
+	}
+
+	buffer := pool.availableBuffers[count-1]
+	pool.availableBuffers = pool.availableBuffers[:count-1]
+	if count-1 < pool.poolSize/5 {
+		Logger.Warnf("TransientStorePool 只剩余 %d 个可用的缓冲区", count-1)
+	}
+	return buffer
+}
+
+// ReturnBuffer 归还缓冲区, 缓冲区中的旧数据会在下一次写入时被覆盖
+func (pool *TransientStorePool) ReturnBuffer(buffer []byte) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if len(pool.availableBuffers) >= pool.poolSize || int64(len(buffer)) != pool.fileSize {
+		return
+	}
+	pool.availableBuffers = append(pool.availableBuffers, buffer)
+}
+
+// AvailableBufferNums 空闲的缓冲区数量
+func (pool *TransientStorePool) AvailableBufferNums() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return len(pool.availableBuffers)
+}
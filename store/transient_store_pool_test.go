@@ -0,0 +1,67 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTransientStorePoolBorrowAndReturn(t *testing.T) {
+	pool := NewTransientStorePool(2, 1024)
+	pool.Init()
+
+	first, second := pool.BorrowBuffer(), pool.BorrowBuffer()
+	if first == nil || second == nil || len(first) != 1024 {
+		t.Fatal("expect two buffers with file size")
+	}
+	if pool.BorrowBuffer() != nil {
+		t.Fatal("expect no available buffer")
+	}
+
+	pool.ReturnBuffer(first)
+	pool.ReturnBuffer(make([]byte, 512))
+	if available := pool.AvailableBufferNums(); available != 1 {
+		t.Fatalf("expect 1 available buffer, got %d", available)
+	}
+}
+
+func TestTransientStorePoolCommit(t *testing.T) {
+	queue := newTestQueue(t, 4)
+	queue.Config.TransientStorePoolEnable = true
+	queue.Config.CommitInterval = time.Hour
+	queue.Config.CommitThoroughInterval = time.Hour
+	queue.Start()
+	defer queue.Shutdown()
+
+	if _, err := queue.AppendRecord(NewRecord(testBody(0))); err != nil {
+		t.Fatal(err)
+	}
+
+	//没有提交的数据不能被读取
+	if queue.GetMaxOffset() != 0 || queue.GetMaxWrotePosition() == 0 {
+		t.Fatalf("unexpected max offset %d, max wrote position %d", queue.GetMaxOffset(), queue.GetMaxWrotePosition())
+	}
+
+	for i := 1; i < 10; i++ {
+		if _, err := queue.AppendRecord(NewRecord(testBody(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commitAll(queue)
+	if queue.GetMaxOffset() != queue.GetMaxWrotePosition() || queue.GetCommittedWhere() != queue.GetMaxOffset() {
+		t.Fatalf("expect all data committed, max offset %d, committed where %d", queue.GetMaxOffset(), queue.GetCommittedWhere())
+	}
+
+	it := queue.Iterator(0)
+	defer it.Close()
+	count := 0
+	for ; it.Next(); count++ {
+		if !bytes.Equal(it.Record().Body, testBody(count)) {
+			t.Fatalf("unexpected record %d body %q", count, it.Record().Body)
+		}
+	}
+	if count != 10 {
+		t.Fatalf("expect 10 records, got %d", count)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package store
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// fallocate 为文件预先分配磁盘空间, 避免写入时因为磁盘已满触发SIGBUS
+func fallocate(file *os.File, size int64) error {
+	return unix.Fallocate(int(file.Fd()), 0, 0, size)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package store
+
+import (
+	"os"
+)
+
+// fallocate 非Linux系统不支持预先分配磁盘空间, 依赖预热时的写入分配
+func fallocate(file *os.File, size int64) error {
+	return nil
+}